@@ -0,0 +1,167 @@
+// +build integration_test
+
+package test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// artifactBundle is a tarball of diagnostics collected after a test fails.
+	artifactBundle struct {
+		tw *tar.Writer
+		lg logger
+	}
+)
+
+// artifactNamespaces are the namespaces whose pods and events are collected.
+var artifactNamespaces = []string{fluxNamespace, appNamespace, helmReleaseNamespace}
+
+// add writes a file to the bundle, with secrets redacted: values and the
+// repo clone hold the git http password, and logs may hold anything.
+func (b *artifactBundle) add(name string, content []byte) {
+	content = []byte(secrets.redact(string(content)))
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		b.lg.Logf("unable to add %q to artifact bundle: %v", name, err)
+		return
+	}
+	if _, err := b.tw.Write(content); err != nil {
+		b.lg.Logf("unable to add %q to artifact bundle: %v", name, err)
+	}
+}
+
+// addOutput writes the output of a command to the bundle, or the error if
+// it failed.
+func (b *artifactBundle) addOutput(name string, out string, err error) {
+	if err != nil {
+		b.add(name+".error", []byte(err.Error()))
+		return
+	}
+	b.add(name, []byte(out))
+}
+
+// addDir writes the regular files under dir to the bundle, under prefix.
+func (b *artifactBundle) addDir(prefix string, dir string) {
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		b.add(filepath.ToSlash(filepath.Join(prefix, rel)), content)
+		return nil
+	})
+	if err != nil {
+		b.lg.Logf("unable to add %q to artifact bundle: %v", dir, err)
+	}
+}
+
+// collectArtifacts writes a tarball of everything that might help diagnose
+// a failure of the test to the artifacts dir.
+func (h *harness) collectArtifacts() {
+	if global.artifactsDir == "" {
+		return
+	}
+	if err := os.MkdirAll(global.artifactsDir, 0755); err != nil {
+		h.lg.Logf("unable to create artifacts dir: %v", err)
+		return
+	}
+	path := filepath.Join(global.artifactsDir, perTestFilename(h.t.Name(), ".tar.gz"))
+	f, err := os.Create(path)
+	if err != nil {
+		h.lg.Logf("unable to create artifact bundle: %v", err)
+		return
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	b := &artifactBundle{tw: tar.NewWriter(gz), lg: h.lg}
+	defer b.tw.Close()
+
+	h.lg.Logf("test failed, collecting artifacts in %s", path)
+	b.addDir("repo", h.repodir)
+	if h.gitAPI != nil {
+		if err := h.fetch(); err != nil {
+			h.lg.Logf("unable to fetch before collecting git log: %v", err)
+		}
+		out, err := h.log(h.upstreamRef(), h.syncTag)
+		b.addOutput("git-log.txt", out, err)
+	}
+	h.collectHelmArtifacts(b)
+	h.collectKubeArtifacts(b)
+}
+
+func (h *harness) collectHelmArtifacts(b *artifactBundle) {
+	releases, err := h.helmAPI.list()
+	if err != nil {
+		b.addOutput("helm/list.txt", "", err)
+		return
+	}
+	for _, rel := range releases {
+		hist, err := h.helmAPI.history(rel)
+		if err != nil {
+			b.addOutput(fmt.Sprintf("helm/%s/history.json", rel), "", err)
+			continue
+		}
+		histjson, _ := json.MarshalIndent(hist, "", "  ")
+		b.add(fmt.Sprintf("helm/%s/history.json", rel), histjson)
+		if len(hist) > 0 {
+			out, err := h.helmAPI.getValues(rel, hist[len(hist)-1].Revision)
+			b.addOutput(fmt.Sprintf("helm/%s/values.yaml", rel), out, err)
+		}
+	}
+}
+
+func (h *harness) collectKubeArtifacts(b *artifactBundle) {
+	k := global.kubectlAPI.withLogger(h.lg)
+	for _, ns := range artifactNamespaces {
+		out, err := k.get(ns, "pods", "-o", "wide")
+		b.addOutput(fmt.Sprintf("k8s/%s/pods.txt", ns), out, err)
+		out, err = k.get(ns, "events", "--sort-by=.lastTimestamp")
+		b.addOutput(fmt.Sprintf("k8s/%s/events.txt", ns), out, err)
+	}
+
+	// Logs from everything in the flux namespace: flux, the helm operator,
+	// memcached and the git server.
+	out, err := k.get(fluxNamespace, "pods", "-o", "name")
+	if err != nil {
+		h.lg.Logf("unable to list pods for logs: %v", err)
+		return
+	}
+	for _, pod := range strings.Fields(out) {
+		name := strings.TrimPrefix(pod, "pod/")
+		containers, err := k.get(fluxNamespace, "pod", name, "-o", "jsonpath={.spec.containers[*].name}")
+		if err != nil {
+			b.addOutput(fmt.Sprintf("logs/%s/%s.log", fluxNamespace, name), "", err)
+			continue
+		}
+		for _, c := range strings.Fields(containers) {
+			base := fmt.Sprintf("logs/%s/%s/%s", fluxNamespace, name, c)
+			out, err := k.logs(fluxNamespace, name, c, false)
+			b.addOutput(base+".log", out, err)
+			if out, err := k.logs(fluxNamespace, name, c, true); err == nil {
+				b.add(base+".previous.log", []byte(out))
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// auditEvent is one line of an audit log.  Which fields are set depends
+	// on Kind, which is one of "command", "http" or "poll".
+	auditEvent struct {
+		Time     time.Time     `json:"time"`
+		Kind     string        `json:"kind"`
+		Duration time.Duration `json:"duration"`
+		Error    string        `json:"error,omitempty"`
+
+		// command
+		Args     []string `json:"args,omitempty"`
+		ExitCode *int     `json:"exitCode,omitempty"`
+
+		// http
+		Method string `json:"method,omitempty"`
+		URL    string `json:"url,omitempty"`
+		Status int    `json:"status,omitempty"`
+
+		// poll
+		Attempt int `json:"attempt,omitempty"`
+	}
+
+	// auditLog is a JSON-lines record of everything done on behalf of one
+	// test.  A nil *auditLog discards events.
+	auditLog struct {
+		mu  sync.Mutex
+		f   *os.File
+		enc *json.Encoder
+	}
+
+	// auditLogs maps logger names to audit logs stored under dir.
+	auditLogs struct {
+		mu     sync.Mutex
+		dir    string
+		byName map[string]*auditLog
+	}
+
+	// auditor is an executor that records each invocation of the executor it
+	// wraps in an audit log.
+	auditor struct {
+		e  executor
+		al *auditLog
+	}
+
+	// auditTransport is an http.RoundTripper that records each request in an
+	// audit log.
+	auditTransport struct {
+		base http.RoundTripper
+		al   *auditLog
+	}
+
+	auditLogKey struct{}
+)
+
+func newAuditLogs(dir string) (*auditLogs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create audit dir %q: %v", dir, err)
+	}
+	return &auditLogs{dir: dir, byName: make(map[string]*auditLog)}, nil
+}
+
+// get returns the audit log for the logger with the given name, creating it
+// if need be.
+func (as *auditLogs) get(name string) (*auditLog, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if al, ok := as.byName[name]; ok {
+		return al, nil
+	}
+	path := filepath.Join(as.dir, perTestFilename(name, ".jsonl"))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create audit log: %v", err)
+	}
+	al := &auditLog{f: f, enc: json.NewEncoder(f)}
+	as.byName[name] = al
+	return al, nil
+}
+
+// close closes all the audit logs.
+func (as *auditLogs) close() {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	for _, al := range as.byName {
+		al.f.Close()
+	}
+}
+
+// decorate is suitable for use in cliDecorators.
+func (as *auditLogs) decorate(lg logger, env []string, e executor) executor {
+	al, err := as.get(lg.Name())
+	if err != nil {
+		lg.Errorf("%v", err)
+	}
+	return auditor{e: e, al: al}
+}
+
+func (al *auditLog) record(ev auditEvent) {
+	if al == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Error != "" {
+		ev.Error = secrets.redact(ev.Error)
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	// Nothing useful to be done with an error here, and the test shouldn't
+	// fail because of it.
+	_ = al.enc.Encode(ev)
+}
+
+// withAuditLog returns a context carrying al, for use by helpers that don't
+// otherwise know which test they're working on behalf of.
+func withAuditLog(ctx context.Context, al *auditLog) context.Context {
+	return context.WithValue(ctx, auditLogKey{}, al)
+}
+
+// auditLogFrom returns the audit log carried by ctx, or nil if none.
+func auditLogFrom(ctx context.Context) *auditLog {
+	al, _ := ctx.Value(auditLogKey{}).(*auditLog)
+	return al
+}
+
+// httpClient returns a client that records requests to al.
+func (al *auditLog) httpClient() *http.Client {
+	if al == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: auditTransport{base: http.DefaultTransport, al: al}}
+}
+
+func (a auditor) exec(ctx context.Context, in string, args ...string) cmdResult {
+	start := time.Now()
+	res := a.e.exec(ctx, in, args...)
+	redactedArgs := make([]string, len(args))
+	for i, arg := range args {
+		redactedArgs[i] = secrets.redact(arg)
+	}
+	exitCode := res.ExitCode
+	ev := auditEvent{
+		Time:     start,
+		Kind:     "command",
+		Duration: res.Duration,
+		Args:     redactedArgs,
+		ExitCode: &exitCode,
+	}
+	if res.Err != nil {
+		ev.Error = res.Err.Error()
+	}
+	a.al.record(ev)
+	return res
+}
+
+func (at auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := at.base.RoundTrip(req)
+	ev := auditEvent{
+		Time:     start,
+		Kind:     "http",
+		Duration: time.Since(start),
+		Method:   req.Method,
+		URL:      req.URL.String(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	} else {
+		ev.Status = resp.StatusCode
+	}
+	at.al.record(ev)
+	return resp, err
+}
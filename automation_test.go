@@ -0,0 +1,116 @@
+// +build integration_test
+
+package test
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/weaveworks/flux/image"
+)
+
+type (
+	// imageUpdate is a change we expect automation to make to the image of a
+	// container in a manifest.
+	imageUpdate struct {
+		file      string
+		container string
+		from, to  image.Ref
+	}
+)
+
+func (u imageUpdate) key() string {
+	return u.file + ":" + u.container
+}
+
+// verifyAutomationCommits checks the commits flux has pushed on top of
+// since: each must be an automated release made as the chart's git user,
+// between them they must make exactly the wanted image updates, and they
+// must change nothing else.
+func (h *harness) verifyAutomationCommits(since string, want []imageUpdate) {
+	h.t.Helper()
+	h.mustFetch()
+	commits, err := h.commits(since, h.upstreamRef())
+	h.must(err)
+	if len(commits) == 0 {
+		h.t.Errorf("No automation commits found after %s", since)
+		return
+	}
+
+	remaining := make(map[string]imageUpdate)
+	for _, u := range want {
+		remaining[u.key()] = u
+	}
+	// Oldest first, so each update is seen in the order flux made it.
+	for i := len(commits) - 1; i >= 0; i-- {
+		h.verifyAutomationCommit(commits[i], remaining)
+	}
+	for _, u := range remaining {
+		h.t.Errorf("Container %s in %s was not updated from %s to %s", u.container, u.file, u.from, u.to)
+	}
+}
+
+// verifyAutomationCommit checks a single automation commit, removing the
+// updates it makes from remaining.
+func (h *harness) verifyAutomationCommit(c gitCommit, remaining map[string]imageUpdate) {
+	h.t.Helper()
+	if c.Committer.Name != fluxGitUser || c.Committer.Email != fluxGitEmail {
+		h.t.Errorf("Commit %s was made by %s <%s>, want %s <%s>", c.Hash,
+			c.Committer.Name, c.Committer.Email, fluxGitUser, fluxGitEmail)
+	}
+	msgImages, err := parseAutoReleaseMessage(c.Message)
+	if err != nil {
+		h.t.Errorf("Commit %s: %v", c.Hash, err)
+	}
+	if len(c.Parents) != 1 {
+		h.t.Errorf("Commit %s has parents %v, want exactly one", c.Hash, c.Parents)
+		return
+	}
+	parent := c.Parents[0]
+
+	diffs, err := h.diff(parent, c.Hash)
+	h.must(err)
+	var changed []string
+	for _, d := range diffs {
+		if d.Status != "M" {
+			h.t.Errorf("Commit %s has %s %s, want only modifications:\n%s", c.Hash, d.Status, d.Path, d.Patch)
+			continue
+		}
+		before, err := h.show(parent, d.Path)
+		h.must(err)
+		after, err := h.show(c.Hash, d.Path)
+		h.must(err)
+
+		oldImages := containerImages(before)
+		updates := make(map[string]string)
+		for container, img := range containerImages(after) {
+			if oldImages[container] == img {
+				continue
+			}
+			key := d.Path + ":" + container
+			u, ok := remaining[key]
+			switch {
+			case !ok:
+				h.t.Errorf("Commit %s unexpectedly changes container %s in %s from %s to %s",
+					c.Hash, container, d.Path, oldImages[container], img)
+			case oldImages[container] != u.from.String() || img != u.to.String():
+				h.t.Errorf("Commit %s changes container %s in %s from %s to %s, want %s to %s",
+					c.Hash, container, d.Path, oldImages[container], img, u.from, u.to)
+			}
+			delete(remaining, key)
+			updates[container] = img
+			changed = append(changed, img)
+		}
+		if withImages(before, updates) != after {
+			h.t.Errorf("Commit %s changes %s beyond updating images:\n%s", c.Hash, d.Path, d.Patch)
+		}
+	}
+
+	if msgImages != nil {
+		sort.Strings(msgImages)
+		sort.Strings(changed)
+		if !reflect.DeepEqual(msgImages, changed) {
+			h.t.Errorf("Commit %s message names images %v but it changes %v", c.Hash, msgImages, changed)
+		}
+	}
+}
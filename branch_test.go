@@ -0,0 +1,68 @@
+// +build integration_test
+
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	// decoyHelloworldImageTag and decoySidecarImageTag are the image tags
+	// deployed by commits flux should ignore.
+	decoyHelloworldImageTag = automatedHelloworldImageTag
+	decoySidecarImageTag    = automatedSidecarImageTag
+)
+
+// pushDecoy writes a helloworld deployment using the decoy tags to dir in
+// our clone, commits it and pushes it to branch.
+func (h *harness) pushDecoy(dir string, branch string) {
+	h.t.Helper()
+	_, err := writeHelloWorldDeployment(dir, decoyHelloworldImageTag, decoySidecarImageTag)
+	h.must(err)
+	rev, err := h.addCommit("decoy")
+	h.must(err)
+	h.must(h.push(branch))
+	h.lg.Logf("pushed decoy commit %s to %s", rev, branch)
+}
+
+// pushUnrelatedChange commits and pushes a file flux doesn't care about, so
+// that there's something new for it to sync.
+func (h *harness) pushUnrelatedChange() {
+	h.t.Helper()
+	h.must(ioutil.WriteFile(filepath.Join(h.repodir, "NOTES"), []byte(h.t.Name()+"\n"), 0644))
+	h.mustAddCommitPush()
+}
+
+// TestSyncBranch makes sure flux syncs from the branch it's configured with,
+// and ignores commits to master.
+func TestSyncBranch(t *testing.T) {
+	h := newharnessWith(t, harnessOptions{branch: "deploy"})
+	defer h.done()
+	h.applyFlux()
+	h.deployViaGit(context.TODO())
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+
+	// Push the decoy to master, then drop it so it's not pushed to deploy
+	// along with the change that follows.
+	h.pushDecoy(h.manifestDir(), "master")
+	h.must(h.reset("HEAD~1"))
+	h.pushUnrelatedChange()
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+}
+
+// TestSyncPath makes sure flux only applies manifests from the configured
+// path within the repo, while still syncing commits that touch nothing
+// under it.
+func TestSyncPath(t *testing.T) {
+	h := newharnessWith(t, harnessOptions{gitPath: "manifests/prod"})
+	defer h.done()
+	h.applyFlux()
+	h.deployViaGit(context.TODO())
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+
+	h.pushDecoy(filepath.Join(h.repodir, "manifests", "staging"), h.branch)
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type (
+	// clusterAPI is a provider of the kubernetes cluster the tests run in.
+	clusterAPI interface {
+		// name identifies the provider, e.g. "minikube".
+		name() string
+		// version describes the provider and the cluster it provides.
+		version() string
+		// start creates the cluster, replacing any that already exists.
+		start()
+		delete()
+		nodeIP() string
+		// loadDockerImage makes a locally built image available to the
+		// cluster without going through a registry.
+		loadDockerImage(string)
+		// kubeContext is the kubeconfig context kubectl and helm should use.
+		kubeContext() string
+		// kubeconfig is the KUBECONFIG kubectl and helm should use, empty
+		// for the default ~/.kube/config.
+		kubeconfig() string
+		// withLogger returns a copy of the provider that logs to lg.
+		withLogger(lg logger) clusterAPI
+	}
+
+	// clusterOptions holds the settings providers are built from; each
+	// provider uses only those relevant to it.
+	clusterOptions struct {
+		minikubeProfile string
+		minikubeDriver  string
+		// kubeContext is the context used by the kubeconfig provider,
+		// empty for the current context.
+		kubeContext string
+	}
+
+	// clusterProvider describes how to build a clusterAPI.
+	clusterProvider struct {
+		// tools the provider needs beyond requiredTools.
+		tools []toolSpec
+		// loadsImages is set if the provider can load images from the
+		// host's docker, so that requiredImages should be preloaded.
+		loadsImages bool
+		new         func(lg logger, tools *toolchain, opts clusterOptions) clusterAPI
+	}
+)
+
+var clusterProviders = map[string]clusterProvider{
+	"minikube": {
+		tools: []toolSpec{
+			{name: "minikube", versionArgs: []string{"version"}},
+			{name: "docker", versionArgs: []string{"version", "--format", "{{.Client.Version}}"}},
+			{name: "scp"},
+		},
+		loadsImages: true,
+		new: func(lg logger, tools *toolchain, opts clusterOptions) clusterAPI {
+			m := mustNewMinikube(lg, tools.path("minikube"), opts.minikubeProfile, opts.minikubeDriver)
+			m.dt.bin = tools.path("docker")
+			m.kt.bin = tools.path("kubectl")
+			m.scp = tools.path("scp")
+			return m
+		},
+	},
+	"kubeconfig": {
+		new: func(lg logger, tools *toolchain, opts clusterOptions) clusterAPI {
+			return mustNewKubeconfigCluster(lg, tools.path("kubectl"), opts.kubeContext)
+		},
+	},
+}
+
+// clusterProviderNames returns the names of the known providers, sorted.
+func clusterProviderNames() []string {
+	var names []string
+	for name := range clusterProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupClusterProvider returns the named provider.
+func lookupClusterProvider(name string) (clusterProvider, error) {
+	p, ok := clusterProviders[name]
+	if !ok {
+		return clusterProvider{}, fmt.Errorf("unknown cluster provider %q, want one of %s",
+			name, strings.Join(clusterProviderNames(), ", "))
+	}
+	return p, nil
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"strings"
+)
+
+type (
+	dockerTool struct {
+		bin string
+	}
+
+	// docker talks to the host's docker daemon.
+	docker struct {
+		dt dockerTool
+		lg logger
+	}
+)
+
+func (dt dockerTool) imageIDCmd(ref string) []string {
+	return []string{dt.bin, "image", "inspect", "--format", "{{.Id}}", ref}
+}
+
+func (dt dockerTool) pullCmd(ref string) []string {
+	return []string{dt.bin, "pull", ref}
+}
+
+func (dt dockerTool) saveCmd(ref string, path string) []string {
+	return []string{dt.bin, "save", "--output", path, ref}
+}
+
+func (dt dockerTool) loadCmd(path string) []string {
+	return []string{dt.bin, "load", "--input", path}
+}
+
+func (d docker) cli() clicmd {
+	return newCli(withFields(d.lg, "tool", "docker"), nil)
+}
+
+// imageID returns the ID, i.e. the config digest, of the image ref, or an
+// error if the daemon doesn't have it.
+func (d docker) imageID(ref string) (string, error) {
+	ctx, cancel := opContext("docker.inspect")
+	defer cancel()
+	out, err := d.cli().run(ctx, d.dt.imageIDCmd(ref)...)
+	return strings.TrimSpace(out), err
+}
+
+func (d docker) pull(ref string) error {
+	ctx, cancel := opContext("docker.pull")
+	defer cancel()
+	_, err := newStreamingCli(withFields(d.lg, "tool", "docker"), nil).run(ctx, d.dt.pullCmd(ref)...)
+	return err
+}
+
+func (d docker) save(ref string, path string) error {
+	ctx, cancel := opContext("docker.save")
+	defer cancel()
+	_, err := d.cli().run(ctx, d.dt.saveCmd(ref, path)...)
+	return err
+}
+
+func (d docker) load(path string) error {
+	ctx, cancel := opContext("docker.load")
+	defer cancel()
+	_, err := d.cli().run(ctx, d.dt.loadCmd(path)...)
+	return err
+}
@@ -66,4 +66,9 @@ fluxctl_bin=$bindir/fluxctl
 
 curl -s -L -o $fluxctl_dl -z $fluxctl_dl $fluxctl_base/$fluxctl_version/$fluxctl_relname
 chmod 755 $fluxctl_dl
-ln -f $fluxctl_dl $fluxctl_bin
\ No newline at end of file
+ln -f $fluxctl_dl $fluxctl_bin
+
+# git-server chart http sidecar image
+git_http_image=fluxtest/git-http:alpine-3.8
+
+docker image inspect $git_http_image >/dev/null 2>&1 || docker build -q -t $git_http_image "`dirname $0`/docker/git-http"
@@ -0,0 +1,87 @@
+package test
+
+import (
+	"sort"
+	"strings"
+)
+
+type (
+	// envPolicy decides which variables of our own environment are inherited
+	// by the tools we run.  Tool-specific variables are overlaid on top.
+	envPolicy struct {
+		// allow, if non-empty, lists the only variables that are inherited,
+		// besides those in alwaysInherited.
+		allow map[string]bool
+		// deny lists variables that are never inherited.
+		deny map[string]bool
+	}
+)
+
+var (
+	// alwaysInherited variables are needed for tools to work at all.
+	alwaysInherited = []string{"PATH", "HOME"}
+
+	// childEnv is the policy applied by cmdrunner.
+	childEnv = envPolicy{
+		deny: setOf(
+			// We always pass an explicit --context/--kube-context, and
+			// KUBECONFIG as an overlay when the cluster provider wants it.
+			"KUBECONFIG",
+			// We always pass an explicit --home, and want our own tiller.
+			"HELM_HOME", "HELM_HOST", "TILLER_NAMESPACE",
+			// Our git commands operate on our own clones only.
+			"GIT_DIR", "GIT_WORK_TREE", "GIT_SSH", "GIT_SSH_COMMAND",
+		),
+	}
+)
+
+func setOf(names ...string) map[string]bool {
+	set := make(map[string]bool)
+	for _, n := range names {
+		if n != "" {
+			set[n] = true
+		}
+	}
+	return set
+}
+
+func envName(kv string) string {
+	if i := strings.Index(kv, "="); i >= 0 {
+		return kv[:i]
+	}
+	return kv
+}
+
+func (p envPolicy) inherits(name string) bool {
+	for _, n := range alwaysInherited {
+		if n == name {
+			return true
+		}
+	}
+	if p.deny[name] {
+		return false
+	}
+	return len(p.allow) == 0 || p.allow[name]
+}
+
+// build returns the environment for a child process: the variables from
+// parent permitted by the policy, with overlay variables added or replacing
+// those of the same name.
+func (p envPolicy) build(parent, overlay []string) []string {
+	vars := make(map[string]string)
+	for _, kv := range parent {
+		if name := envName(kv); p.inherits(name) {
+			vars[name] = kv
+		}
+	}
+	for _, kv := range overlay {
+		vars[envName(kv)] = kv
+	}
+
+	env := make([]string, 0, len(vars))
+	for _, kv := range vars {
+		env = append(env, kv)
+	}
+	sort.Strings(env)
+	return env
+}
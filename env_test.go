@@ -0,0 +1,28 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvPolicyBuild(t *testing.T) {
+	parent := []string{"PATH=/bin", "HOME=/root", "KUBECONFIG=/k", "LANG=C", "GIT_SSH_COMMAND=ssh"}
+	overlay := []string{"GIT_SSH_COMMAND=ssh -i key", "LANG=en"}
+
+	for _, tc := range []struct {
+		name   string
+		policy envPolicy
+		want   []string
+	}{
+		{"deny", envPolicy{deny: setOf("KUBECONFIG", "GIT_SSH_COMMAND")},
+			[]string{"GIT_SSH_COMMAND=ssh -i key", "HOME=/root", "LANG=en", "PATH=/bin"}},
+		{"allow", envPolicy{allow: setOf("KUBECONFIG")},
+			[]string{"GIT_SSH_COMMAND=ssh -i key", "HOME=/root", "KUBECONFIG=/k", "LANG=en", "PATH=/bin"}},
+		{"always inherited", envPolicy{deny: setOf("PATH", "HOME", "LANG")},
+			[]string{"GIT_SSH_COMMAND=ssh -i key", "HOME=/root", "KUBECONFIG=/k", "LANG=en", "PATH=/bin"}},
+	} {
+		if got := tc.policy.build(parent, overlay); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type (
+	// fakeExpectation is a command the fakeCli expects to be run, and the
+	// response to give when it is.
+	fakeExpectation struct {
+		desc     string
+		match    func(args []string) bool
+		stdout   string
+		stderr   string
+		exitCode int
+		consumed bool
+	}
+
+	// fakeCli is an executor test double.  Expectations are consumed in the
+	// order they were added: each invocation is served by the first
+	// unconsumed expectation that matches it.
+	fakeCli struct {
+		t            *testing.T
+		mu           sync.Mutex
+		expectations []*fakeExpectation
+	}
+
+	// fatalRecorder is a logger whose Fatalf unwinds via panic rather than
+	// failing the test, so that tests can verify fatal paths.
+	fatalRecorder struct {
+		*testing.T
+		msg string
+	}
+)
+
+func newFakeCli(t *testing.T) *fakeCli {
+	return &fakeCli{t: t}
+}
+
+// expect adds an expectation for exactly the given command line.
+func (f *fakeCli) expect(args ...string) *fakeExpectation {
+	want := append([]string(nil), args...)
+	return f.expectMatch(fmt.Sprintf("%v", want), func(got []string) bool {
+		return reflect.DeepEqual(got, want)
+	})
+}
+
+// expectMatch adds an expectation for any command line accepted by match.
+func (f *fakeCli) expectMatch(desc string, match func(args []string) bool) *fakeExpectation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := &fakeExpectation{desc: desc, match: match}
+	f.expectations = append(f.expectations, e)
+	return e
+}
+
+// returns sets the stdout of a successful invocation.
+func (e *fakeExpectation) returns(stdout string) *fakeExpectation {
+	e.stdout = stdout
+	return e
+}
+
+// fails makes the invocation exit with status 1 and the given stderr.
+func (e *fakeExpectation) fails(stderr string) *fakeExpectation {
+	e.stderr, e.exitCode = stderr, 1
+	return e
+}
+
+func (f *fakeCli) exec(ctx context.Context, in string, args ...string) cmdResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.expectations {
+		if e.consumed || !e.match(args) {
+			continue
+		}
+		e.consumed = true
+		res := cmdResult{Path: args[0], Args: args, Stdout: e.stdout, Stderr: e.stderr, ExitCode: e.exitCode}
+		if e.exitCode != 0 {
+			res.Err = fmt.Errorf("exit status %d", e.exitCode)
+		}
+		return res
+	}
+	f.t.Errorf("unexpected command %v", args)
+	return cmdResult{Args: args, ExitCode: -1, Err: fmt.Errorf("unexpected command %v", args)}
+}
+
+// install makes newCli return clicmds backed by f, until the returned
+// function is called, which also verifies all expectations were consumed.
+func (f *fakeCli) install() func() {
+	saved := cliDecorators
+	cliDecorators = []func(logger, []string, executor) executor{
+		func(logger, []string, executor) executor { return f },
+	}
+	return func() {
+		cliDecorators = saved
+		f.verify()
+	}
+}
+
+// verify reports an error for each expectation that wasn't consumed.
+func (f *fakeCli) verify() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var missing []string
+	for _, e := range f.expectations {
+		if !e.consumed {
+			missing = append(missing, e.desc)
+		}
+	}
+	if len(missing) > 0 {
+		f.t.Errorf("expected commands not run:\n%s", strings.Join(missing, "\n"))
+	}
+}
+
+func (r *fatalRecorder) Fatalf(s string, args ...interface{}) {
+	r.msg = fmt.Sprintf(s, args...)
+	panic(r)
+}
+
+// expectFatal calls f and returns the message it passed to Fatalf, failing
+// the test if it didn't.
+func expectFatal(t *testing.T, f func(lg logger)) (msg string) {
+	t.Helper()
+	lg := &fatalRecorder{T: t}
+	defer func() {
+		if r := recover(); r != lg {
+			if r != nil {
+				panic(r)
+			}
+			t.Errorf("expected a fatal error")
+		}
+		msg = lg.msg
+	}()
+	f(lg)
+	return ""
+}
@@ -6,11 +6,9 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"testing"
 	"text/template"
@@ -18,6 +16,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/weaveworks/flux/image"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 )
 
 const (
@@ -31,10 +30,22 @@ const (
 	automationUpdateTimeout = 180 * time.Second
 	fluxPort                = "30080"
 	gitRepoPath             = "/git-server/repos/repo.git"
-	helloworldImageTag      = "master-a000001"
-	sidecarImageTag         = "master-a000001"
-	appNamespace            = "default"
-	fluxSyncTag             = "flux-sync"
+	// gitHTTPPort serves the repo over http or https, as configured.
+	gitHTTPPort         = 30443
+	gitHTTPUser         = "flux"
+	gitHTTPSetupTimeout = 30 * time.Second
+	helloworldImageTag  = "master-a000001"
+	sidecarImageTag     = "master-a000001"
+	// automatedHelloworldImageTag and automatedSidecarImageTag are the
+	// newest tags, which automation updates to.
+	automatedHelloworldImageTag = "master-07a1b6b"
+	automatedSidecarImageTag    = "master-a000002"
+	appNamespace                = "default"
+	fluxSyncTag                 = "flux-sync"
+	// fluxGitUser and fluxGitEmail are who flux commits as.
+	fluxGitUser        = "Flux Automation"
+	fluxGitEmail       = "flux-automation@example.com"
+	helloworldManifest = "helloworld-deployment.yaml"
 )
 
 type (
@@ -42,10 +53,30 @@ type (
 	harness struct {
 		clusterIP string
 		t         *testing.T
-		repodir   string
+		lg        *structLogger
+		// ctx carries the test's audit log; derive contexts from it.
+		ctx     context.Context
+		repodir string
+		harnessOptions
 		clusterAPI
 		gitAPI
 		helmAPI
+		probes probeAPI
+	}
+
+	// harnessOptions configure how flux is pointed at the git repo.
+	harnessOptions struct {
+		// branch is the branch flux syncs from and we push to, default master.
+		branch string
+		// gitPath is the subdirectory of the repo flux looks for manifests
+		// in, default the top level.
+		gitPath string
+		// syncTag is the tag flux marks its progress with, default
+		// fluxSyncTag.
+		syncTag string
+		// gitTransport is how we and flux talk to the git server: ssh
+		// (the default), http or https.
+		gitTransport string
 	}
 )
 
@@ -55,54 +86,148 @@ var (
 )
 
 func newharness(t *testing.T) *harness {
+	return newharnessWith(t, harnessOptions{})
+}
+
+func newharnessWith(t *testing.T, opts harnessOptions) *harness {
+	if opts.branch == "" {
+		opts.branch = "master"
+	}
+	if opts.syncTag == "" {
+		opts.syncTag = fluxSyncTag
+	}
+	if opts.gitTransport == "" {
+		opts.gitTransport = "ssh"
+	}
 	testdir := filepath.Join(global.testroot, t.Name())
 	os.Mkdir(testdir, 0755)
 
 	repodir := filepath.Join(testdir, "repo")
+	al, err := global.audits.get(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg := newTestLogger(t)
 	h := &harness{
-		repodir:    repodir,
-		t:          t,
-		clusterIP:  global.clusterIP,
-		clusterAPI: minikube{mt: global.clusterAPI.(minikube).mt, lg: t},
-		helmAPI:    helm{ht: global.helmAPI.(helm).ht, lg: t},
+		repodir:        repodir,
+		harnessOptions: opts,
+		t:              t,
+		lg:             lg,
+		ctx:            withAuditLog(rootCtx, al),
+		clusterIP:      global.clusterIP,
+		clusterAPI:     global.clusterAPI.withLogger(lg),
+		helmAPI:        global.helmAPI.withLogger(lg),
+		probes:         newProber(lg),
 	}
+	// Collect artifacts if setup fails; after that it's up to the test's
+	// deferred h.done().
+	setupDone := false
+	defer func() {
+		if !setupDone && t.Failed() {
+			h.collectArtifacts()
+		}
+	}()
+
+	k := global.kubectlAPI.withLogger(lg)
 
 	// Create configmap for our public key
 	pubkeyConfigMap := "ssh-public-keys"
-	global.kubectlAPI.delete(fluxNamespace, "configmap", pubkeyConfigMap)
-	global.must(global.kubectlAPI.create(fluxNamespace, "configmap", pubkeyConfigMap, "--from-file",
+	k.delete(fluxNamespace, "configmap", pubkeyConfigMap)
+	h.must(k.create(fluxNamespace, "configmap", pubkeyConfigMap, "--from-file",
 		fmt.Sprintf("me.pub=%s", global.sshKeyFilePublic())))
 
 	// Create secret for our private key
 	secretName := "flux-git-deploy"
-	global.kubectlAPI.delete(fluxNamespace, "secret", secretName)
-	global.must(global.kubectlAPI.create(fluxNamespace, "secret", "generic", secretName, "--from-file",
+	k.delete(fluxNamespace, "secret", secretName)
+	h.must(k.create(fluxNamespace, "secret", "generic", secretName, "--from-file",
 		fmt.Sprintf("identity=%s", global.sshKeyFilePrivate())))
 
 	// Install git service, which depends on the public key
 	h.installGitChart()
-	portOpen(context.Background(), h.clusterIP, 30022)
+	portOpen(h.ctx, h.probes, h.clusterIP, 30022)
 
 	// Get the ssh host id
-	knownHostsContent := execNoErr(context.TODO(), nil, "ssh-keyscan", "-p", "30022", global.clusterIP)
+	ctx, cancel := opContext("ssh-keyscan")
+	knownHostsContent := h.cli().must(ctx, global.tools.path("ssh-keyscan"), "-p", "30022", global.clusterIP)
+	cancel()
 	ioutil.WriteFile(global.knownHostsPath(), []byte(knownHostsContent), 0600)
 
 	// Record ssh host id in configmap for flux to use
 	configMapName := "ssh-known-hosts"
-	global.kubectlAPI.delete(fluxNamespace, "configmap", configMapName)
-	global.must(global.kubectlAPI.create(fluxNamespace, "configmap", configMapName, "--from-file",
+	k.delete(fluxNamespace, "configmap", configMapName)
+	h.must(k.create(fluxNamespace, "configmap", configMapName, "--from-file",
 		fmt.Sprintf("known_hosts=%s", global.knownHostsPath())))
 
-	// Now setup our local clone of the ssh repo.
-	h.gitAPI = mustNewGit(t, repodir,
-		fmt.Sprintf(`ssh -i %s -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s`,
-			global.sshKeyFilePrivate(), global.knownHostsPath()), h.gitURL())
+	if opts.gitTransport != "ssh" {
+		// The HTTP server generates its password file and certificate on startup.
+		h.must(portOpenWithin(h.ctx, h.probes, h.clusterIP, gitHTTPPort, gitHTTPSetupTimeout))
+	}
 
+	// Now setup our local clone of the repo.
+	switch global.gitImpl {
+	case "cli":
+		h.gitAPI = mustNewGit(lg, global.tools.path("git"), repodir, h.gitEnv(), h.gitURL(), opts.branch)
+	default:
+		var auth transport.AuthMethod
+		switch opts.gitTransport {
+		case "ssh":
+			if global.replaying {
+				// The key was never generated, and go-git won't connect.
+				break
+			}
+			auth, err = sshAuth(global.sshKeyFilePrivate(), global.knownHostsPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+		case "https":
+			skipTLSVerify(fmt.Sprintf("%s:%d", h.clusterIP, gitHTTPPort))
+		}
+		// For http(s), the credentials are in the URL.
+		h.gitAPI = mustNewNativeGit(lg, repodir, auth, h.gitURL(), opts.branch)
+	}
+
+	setupDone = true
 	return h
 }
 
+// done should be deferred by every test using the harness.  It collects
+// artifacts if the test failed.
+func (h *harness) done() {
+	if h.t.Failed() {
+		h.collectArtifacts()
+	}
+}
+
+// gitEnv returns the environment the git binary needs to reach our repo.
+func (h *harness) gitEnv() []string {
+	switch h.gitTransport {
+	case "ssh":
+		return []string{fmt.Sprintf(`GIT_SSH_COMMAND=ssh -i %s -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s`,
+			global.sshKeyFilePrivate(), global.knownHostsPath())}
+	case "https":
+		return []string{"GIT_SSL_NO_VERIFY=true"}
+	}
+	return nil
+}
+
+// cli returns a clicmd for running miscellaneous tools on behalf of the test.
+func (h *harness) cli() clicmd {
+	return newCli(h.lg, nil)
+}
+
+// gitURL is the URL of our repo for the configured transport.  For
+// http(s), it includes the credentials.
 func (h *harness) gitURL() string {
-	return fmt.Sprintf("ssh://git@%s:30022%s", h.clusterIP, gitRepoPath)
+	if h.gitTransport == "ssh" {
+		return fmt.Sprintf("ssh://git@%s:30022%s", h.clusterIP, gitRepoPath)
+	}
+	u := &url.URL{
+		Scheme: h.gitTransport,
+		User:   url.UserPassword(gitHTTPUser, global.gitHTTPToken),
+		Host:   fmt.Sprintf("%s:%d", h.clusterIP, gitHTTPPort),
+		Path:   "/" + filepath.Base(gitRepoPath),
+	}
+	return u.String()
 }
 
 func (h *harness) fluxURL() string {
@@ -141,9 +266,12 @@ func writeTemplate(destdir, tplpath string, values interface{}) (string, error)
 	return foutpath, nil
 }
 
-func writeHelloWorldDeployment(destdir string) (string, error) {
+func writeHelloWorldDeployment(destdir string, helloworldImageTag string, sidecarImageTag string) (string, error) {
+	if err := os.MkdirAll(destdir, 0755); err != nil {
+		return "", err
+	}
 	return writeTemplate(destdir, "nohelm/helloworld-deployment.yaml.tpl",
-		struct{ ImageTag string }{helloworldImageTag})
+		struct{ HelloworldImageTag, SidecarImageTag string }{helloworldImageTag, sidecarImageTag})
 }
 
 // func writeFluxDeployment(destdir string, giturl string) (string, error) {
@@ -156,26 +284,48 @@ func writeHelloWorldDeployment(destdir string) (string, error) {
 // }
 
 func (h *harness) deployViaGit(ctx context.Context) {
-	log.Printf("deploying hello world via git")
-	_, err := writeHelloWorldDeployment(h.repodir)
+	h.lg.Logf("deploying hello world via git")
+	_, err := writeHelloWorldDeployment(h.manifestDir(), helloworldImageTag, sidecarImageTag)
 	if err != nil {
 		h.t.Fatal(err)
 	}
 	h.mustAddCommitPush()
 }
 
+// manifestDir is where in our clone flux looks for manifests.
+func (h *harness) manifestDir() string {
+	return filepath.Join(h.repodir, h.gitPath)
+}
+
+// manifestPath returns the path relative to the top of the repo of the
+// named manifest file, as it appears in git.
+func (h *harness) manifestPath(name string) string {
+	return filepath.ToSlash(filepath.Join(h.gitPath, name))
+}
+
+// upstreamRef is the remote-tracking ref for the branch flux syncs from.
+func (h *harness) upstreamRef() string {
+	return "refs/remotes/origin/" + h.branch
+}
+
 func (h *harness) waitForSync(ctx context.Context, targetRevSource string) {
+	h.t.Helper()
+	h.waitForSyncTag(ctx, h.syncTag, targetRevSource)
+}
+
+// waitForSyncTag waits for the given sync tag to point at targetRevSource.
+func (h *harness) waitForSyncTag(ctx context.Context, syncTag string, targetRevSource string) {
 	h.t.Helper()
 	h.must(until(ctx, func(ictx context.Context) error {
 		h.mustFetch()
-		targetRev, err := h.revlist("-n", "1", targetRevSource)
+		targetRev, err := h.resolve(targetRevSource)
 		if err != nil {
 			h.t.Fatalf("Unable to get latest rev for %s: %v", targetRevSource, err)
 		}
-		syncRev, _ := h.revlist("-n", "1", fluxSyncTag)
+		syncRev, _ := h.resolve(syncTag)
 		if syncRev != targetRev {
 			return fmt.Errorf("sync tag %q points at %q instead of target %s",
-				fluxSyncTag, syncRev, targetRev)
+				syncTag, syncRev, targetRev)
 		}
 		return nil
 	}))
@@ -184,13 +334,9 @@ func (h *harness) waitForSync(ctx context.Context, targetRevSource string) {
 func (h *harness) waitForUpstreamCommits(ctx context.Context, mincount int) {
 	h.must(until(ctx, func(ictx context.Context) error {
 		h.mustFetch()
-		strcount, _ := h.revlist("--count", "HEAD.."+fluxSyncTag)
-		if strcount == "" {
-			return fmt.Errorf("no output returned by git revlist")
-		}
-		count, err := strconv.Atoi(strings.TrimSpace(strcount))
+		count, err := h.countCommits("HEAD", h.syncTag)
 		if err != nil {
-			h.t.Fatalf("git rev-list --count returned a non-numeric output %q: %v", strcount, err)
+			return err
 		}
 		if count < mincount {
 			return fmt.Errorf("Found %d commits instead of required minimum %d", count, mincount)
@@ -203,7 +349,9 @@ func (h *harness) automate() {
 	// In this case, unlike services() we'll invoke fluxctl to enable automation.  From looking at the fluxctl
 	// source there's more going on than a simple API call.  And it's not like we have to parse the output.
 
-	execNoErr(context.TODO(), h.t, "fluxctl", "--url", h.fluxURL(), "automate",
+	ctx, cancel := opContext("fluxctl.automate")
+	defer cancel()
+	h.cli().must(ctx, global.tools.path("fluxctl"), "--url", h.fluxURL(), "automate",
 		fmt.Sprintf("--controller=%s:deployment/helloworld", appNamespace))
 }
 
@@ -232,11 +380,11 @@ func (h *harness) verifySyncAndSvcs(t *testing.T, targetRevSource, expectedHello
 		got  map[string]image.Ref
 	)
 
-	log.Printf("Waiting %v for sync tag to be current", syncTimeout)
-	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	h.lg.Logf("Waiting %v for sync tag to be current", syncTimeout)
+	ctx, cancel := context.WithTimeout(h.ctx, syncTimeout)
 	h.waitForSync(ctx, targetRevSource)
 	for got == nil || diff != "" {
-		got = fluxServices(ctx, h.fluxURL(), t, appNamespace, appNamespace+":deployment/helloworld")
+		got = fluxServices(ctx, h.probes, h.fluxURL(), t, appNamespace, appNamespace+":deployment/helloworld")
 		diff = cmp.Diff(got, expected)
 	}
 	cancel()
@@ -250,24 +398,34 @@ func (h *harness) verifySyncAndSvcs(t *testing.T, targetRevSource, expectedHello
 // then compares what flux reports for our helloworld deployment versus what we expect.
 func TestSync(t *testing.T) {
 	h := newharness(t)
+	defer h.done()
 	h.applyFlux()
 	h.deployViaGit(context.TODO())
 	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
 }
 
 // TestAutomation does a regular sync, then enables automation and verifies that the
-// images get updated in k8s and that commits are pushed to the git repo.  The contents
-// of the commits are not verified.
+// images get updated in k8s and that the commits pushed to the git repo update
+// exactly those images.
 func TestAutomation(t *testing.T) {
 	h := newharness(t)
+	defer h.done()
 	h.applyFlux()
 	h.deployViaGit(context.TODO())
 	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
 
 	h.automate()
-	ctx, cancel := context.WithTimeout(context.Background(), automationUpdateTimeout)
+	ctx, cancel := context.WithTimeout(h.ctx, automationUpdateTimeout)
 	h.waitForUpstreamCommits(ctx, 2)
 	cancel()
 
-	h.verifySyncAndSvcs(t, "refs/remotes/origin/master", "master-07a1b6b", "master-a000002")
+	h.verifySyncAndSvcs(t, h.upstreamRef(), automatedHelloworldImageTag, automatedSidecarImageTag)
+	h.verifyAutomationCommits("HEAD", []imageUpdate{
+		{h.manifestPath(helloworldManifest), "helloworld",
+			image.Ref{Name: helloworldImageName, Tag: helloworldImageTag},
+			image.Ref{Name: helloworldImageName, Tag: automatedHelloworldImageTag}},
+		{h.manifestPath(helloworldManifest), "sidecar",
+			image.Ref{Name: sidecarImageName, Tag: sidecarImageTag},
+			image.Ref{Name: sidecarImageName, Tag: automatedSidecarImageTag}},
+	})
 }
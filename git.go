@@ -1,38 +1,107 @@
 package test
 
 import (
-	"context"
 	"fmt"
-	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type (
 	gitTool struct {
+		bin     string
 		repodir string
 	}
 
 	git struct {
-		gitSSHCommand string
-		gitOriginURL  string
-		gt            gitTool
-		lg            logger
+		// env is added to the environment of git, e.g. GIT_SSH_COMMAND.
+		env          []string
+		gitOriginURL string
+		// branch is the upstream branch mustAddCommitPush pushes to.
+		branch string
+		gt     gitTool
+		lg     logger
 	}
 
 	gitAPI interface {
+		fetch() error
 		mustFetch()
+		// mustAddCommitPush commits all changes and pushes them to the
+		// branch given when cloning.
 		mustAddCommitPush()
-		revlist(args ...string) (string, error)
+		// addCommit commits all changes in the worktree, returning the hash
+		// of the new commit.
+		addCommit(msg string) (string, error)
+		// push pushes HEAD to the given upstream branch.
+		push(branch string) error
+		// amend replaces HEAD with a commit of all changes in the worktree,
+		// returning the hash of the new commit.
+		amend(msg string) (string, error)
+		// forcePush pushes HEAD to the given upstream branch even if that
+		// discards commits there.
+		forcePush(branch string) error
+		// pushTag creates or moves the tag locally and upstream to rev.
+		pushTag(name, rev string) error
+		// deleteTag deletes the tag locally and upstream.
+		deleteTag(name string) error
+		// resolve returns the hash of the commit rev refers to.
+		resolve(rev string) (string, error)
+		// countCommits returns the number of commits reachable from to but
+		// not from from, i.e. git rev-list --count from..to.
+		countCommits(from, to string) (int, error)
+		// refs maps full ref names to the hashes of the commits they refer to.
+		refs() (map[string]string, error)
+		log(revs ...string) (string, error)
+		// commits returns the commits in from..to, newest first in
+		// topological order, so children precede their parents.  An empty
+		// from means all commits reachable from to.
+		commits(from, to string) ([]gitCommit, error)
+		// show returns the content of the file at path as of rev.
+		show(rev, path string) (string, error)
+		// diff returns the files changed between from and to.
+		diff(from, to string) ([]fileDiff, error)
+		// checkout switches the worktree to the given local branch.
+		checkout(branch string) error
+		// createBranch creates a local branch pointing at rev.
+		createBranch(branch, rev string) error
+		// reset hard-resets the current branch and worktree to rev.
+		reset(rev string) error
+	}
+
+	gitSignature struct {
+		Name  string
+		Email string
+		When  time.Time
+	}
+
+	gitCommit struct {
+		Hash      string
+		Parents   []string
+		Author    gitSignature
+		Committer gitSignature
+		Message   string
+	}
+
+	// fileDiff describes how one file differs between two revisions.
+	fileDiff struct {
+		Path string
+		// Status is A, M or D for added, modified or deleted.
+		Status string
+		// Patch is the unified diff of the file.
+		Patch string
 	}
 )
 
+// commitLogFormat is the git log --format that parseCommitLog expects.
+const commitLogFormat = "%H%x00%P%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%B%x1e"
+
 func (gt gitTool) common() []string {
-	return []string{"git", "-C", gt.repodir}
+	return []string{gt.bin, "-C", gt.repodir}
 }
 
 func (gt gitTool) cloneCmd(originURL string) []string {
-	return []string{"git", "clone", originURL, gt.repodir}
+	return []string{gt.bin, "clone", originURL, gt.repodir}
 }
 
 func (gt gitTool) addCmd(files ...string) []string {
@@ -45,8 +114,33 @@ func (gt gitTool) commitCmd(msg string) []string {
 		"-c", "user.email=flux-test@example.com", "commit", "-m", msg}...)
 }
 
-func (gt gitTool) pushCmd() []string {
-	return append(gt.common(), []string{"push", "-u", "origin", "master"}...)
+func (gt gitTool) pushCmd(branch string) []string {
+	return append(gt.common(), []string{"push", "-u", "origin", "HEAD:refs/heads/" + branch}...)
+}
+
+func (gt gitTool) amendCmd(msg string) []string {
+	return append(gt.common(), []string{"-c", "user.name=flux-test",
+		"-c", "user.email=flux-test@example.com", "commit", "--amend", "-m", msg}...)
+}
+
+func (gt gitTool) forcePushCmd(branch string) []string {
+	return append(gt.common(), []string{"push", "--force", "origin", "HEAD:refs/heads/" + branch}...)
+}
+
+func (gt gitTool) tagCmd(name, rev string) []string {
+	return append(gt.common(), []string{"tag", "--force", name, rev}...)
+}
+
+func (gt gitTool) deleteTagCmd(name string) []string {
+	return append(gt.common(), []string{"tag", "--delete", name}...)
+}
+
+func (gt gitTool) pushTagCmd(name string) []string {
+	return append(gt.common(), []string{"push", "--force", "origin", "refs/tags/" + name}...)
+}
+
+func (gt gitTool) deleteRemoteTagCmd(name string) []string {
+	return append(gt.common(), []string{"push", "origin", ":refs/tags/" + name}...)
 }
 
 func (gt gitTool) revlistCmd(args ...string) []string {
@@ -54,51 +148,343 @@ func (gt gitTool) revlistCmd(args ...string) []string {
 		append([]string{"rev-list"}, args...)...)
 }
 
+func (gt gitTool) revparseCmd(rev string) []string {
+	return append(gt.common(), []string{"rev-parse", "--verify", "--quiet", rev + "^{commit}"}...)
+}
+
+func (gt gitTool) forEachRefCmd() []string {
+	return append(gt.common(),
+		[]string{"for-each-ref", "--format=%(objectname) %(*objectname) %(refname)"}...)
+}
+
+func (gt gitTool) logCmd(revs ...string) []string {
+	return append(gt.common(),
+		append([]string{"log", "--topo-order", "--decorate", "--format=fuller", "--stat"}, revs...)...)
+}
+
+func (gt gitTool) commitLogCmd(revrange string) []string {
+	return append(gt.common(), []string{"log", "--topo-order", "--format=" + commitLogFormat, revrange}...)
+}
+
+func (gt gitTool) showCmd(rev, path string) []string {
+	return append(gt.common(), []string{"show", rev + ":" + path}...)
+}
+
+func (gt gitTool) diffCmd(from, to string) []string {
+	return append(gt.common(), []string{"diff", "--no-renames", "--no-color", from, to}...)
+}
+
+func (gt gitTool) checkoutCmd(branch string) []string {
+	return append(gt.common(), []string{"checkout", branch}...)
+}
+
+func (gt gitTool) branchCmd(branch, rev string) []string {
+	return append(gt.common(), []string{"branch", branch, rev}...)
+}
+
+func (gt gitTool) resetCmd(rev string) []string {
+	return append(gt.common(), []string{"reset", "--hard", rev}...)
+}
+
+// fetchCmd fetches with the same refspecs as nativeGit, forcing them so
+// that tags flux has moved or recreated are updated rather than rejected.
 func (gt gitTool) fetchCmd() []string {
-	return append(gt.common(), []string{"fetch", "--tags"}...)
+	args := append(gt.common(), "fetch", "--force", "origin")
+	for _, refspec := range fetchRefSpecs {
+		args = append(args, refspec.String())
+	}
+	return args
 }
 
-func newGitTool(repodir string) (*gitTool, error) {
+func newGitTool(bin string, repodir string) (*gitTool, error) {
 	_, err := os.Stat(repodir)
 	if err == nil || !os.IsNotExist(err) {
 		return nil, fmt.Errorf("git repodir %s must not already exist", repodir)
 	}
-	return &gitTool{repodir: repodir}, nil
+	return &gitTool{bin: bin, repodir: repodir}, nil
 }
 
-func mustNewGit(lg logger, repodir string, sshcmd string, origin string) git {
-	gt, err := newGitTool(repodir)
+func mustNewGit(lg logger, bin string, repodir string, env []string, origin string, branch string) git {
+	gt, err := newGitTool(bin, repodir)
 	if err != nil {
 		lg.Fatalf("%v", err)
 	}
 
-	g := git{gt: *gt, lg: lg, gitSSHCommand: sshcmd, gitOriginURL: origin}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	g := git{gt: *gt, lg: lg, env: env, gitOriginURL: origin, branch: branch}
+	ctx, cancel := opContext("git.clone")
 	out := g.cli().must(ctx, gt.cloneCmd(origin)...)
-	log.Printf("git clone %q with sshcmd=%q result: %s", origin, sshcmd, out)
+	lg.Logf("git clone %q with env=%q result: %s", secrets.redact(origin),
+		secrets.redact(strings.Join(env, " ")), out)
 	cancel()
 
 	return g
 }
 
 func (g git) cli() clicmd {
-	return newCli(g.lg, []string{"GIT_SSH_COMMAND=" + g.gitSSHCommand})
+	return newCli(withFields(g.lg, "tool", "git"), g.env)
+}
+
+func (g git) fetch() error {
+	ctx, cancel := opContext("git.fetch")
+	defer cancel()
+	_, err := g.cli().run(ctx, g.gt.fetchCmd()...)
+	return err
 }
 
 func (g git) mustFetch() {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	g.cli().must(ctx, g.gt.fetchCmd()...)
-	cancel()
+	if err := g.fetch(); err != nil {
+		g.lg.Fatalf("%v", err)
+	}
 }
 
 func (g git) mustAddCommitPush() {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	g.cli().must(ctx, g.gt.addCmd(".")...)
-	g.cli().must(ctx, g.gt.commitCmd("deploy")...)
-	g.cli().must(ctx, g.gt.pushCmd()...)
-	cancel()
+	if _, err := g.addCommit("deploy"); err != nil {
+		g.lg.Fatalf("%v", err)
+	}
+	if err := g.push(g.branch); err != nil {
+		g.lg.Fatalf("%v", err)
+	}
+}
+
+func (g git) addCommit(msg string) (string, error) {
+	ctx, cancel := opContext("git.commit")
+	defer cancel()
+	if _, err := g.cli().run(ctx, g.gt.addCmd(".")...); err != nil {
+		return "", err
+	}
+	if _, err := g.cli().run(ctx, g.gt.commitCmd(msg)...); err != nil {
+		return "", err
+	}
+	return g.resolve("HEAD")
+}
+
+func (g git) push(branch string) error {
+	ctx, cancel := opContext("git.push")
+	defer cancel()
+	_, err := g.cli().run(ctx, g.gt.pushCmd(branch)...)
+	return err
+}
+
+func (g git) amend(msg string) (string, error) {
+	ctx, cancel := opContext("git.commit")
+	defer cancel()
+	if _, err := g.cli().run(ctx, g.gt.addCmd(".")...); err != nil {
+		return "", err
+	}
+	if _, err := g.cli().run(ctx, g.gt.amendCmd(msg)...); err != nil {
+		return "", err
+	}
+	return g.resolve("HEAD")
+}
+
+func (g git) forcePush(branch string) error {
+	ctx, cancel := opContext("git.push")
+	defer cancel()
+	_, err := g.cli().run(ctx, g.gt.forcePushCmd(branch)...)
+	return err
+}
+
+func (g git) pushTag(name, rev string) error {
+	ctx, cancel := opContext("git.push")
+	defer cancel()
+	if _, err := g.cli().run(ctx, g.gt.tagCmd(name, rev)...); err != nil {
+		return err
+	}
+	_, err := g.cli().run(ctx, g.gt.pushTagCmd(name)...)
+	return err
+}
+
+func (g git) deleteTag(name string) error {
+	ctx, cancel := opContext("git.push")
+	defer cancel()
+	if _, err := g.cli().run(ctx, g.gt.deleteRemoteTagCmd(name)...); err != nil {
+		return err
+	}
+	_, err := g.cli().run(ctx, g.gt.deleteTagCmd(name)...)
+	return err
+}
+
+func (g git) resolve(rev string) (string, error) {
+	ctx, cancel := opContext("git.rev-parse")
+	defer cancel()
+	out, err := g.cli().run(ctx, g.gt.revparseCmd(rev)...)
+	return strings.TrimSpace(out), err
+}
+
+func (g git) countCommits(from, to string) (int, error) {
+	ctx, cancel := opContext("git.rev-list")
+	defer cancel()
+	out, err := g.cli().run(ctx, g.gt.revlistCmd("--count", from+".."+to)...)
+	if err != nil {
+		return 0, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return 0, fmt.Errorf("git rev-list --count returned non-numeric output %q: %v", out, err)
+	}
+	return count, nil
+}
+
+func (g git) refs() (map[string]string, error) {
+	ctx, cancel := opContext("git.for-each-ref")
+	defer cancel()
+	out, err := g.cli().run(ctx, g.gt.forEachRefCmd()...)
+	if err != nil {
+		return nil, err
+	}
+	return parseForEachRef(out)
+}
+
+// pushRejected reports whether err is from a push refused because upstream
+// has moved on since we fetched, by either gitAPI implementation, rather
+// than one that trying again won't fix, e.g. an auth or network failure.
+func pushRejected(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, s := range []string{"[rejected]", "non-fast-forward", "cannot lock ref"} {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForEachRef parses the output of forEachRefCmd.  Annotated tags are
+// peeled to the commits they refer to.
+func parseForEachRef(out string) (map[string]string, error) {
+	refs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected git for-each-ref output line %q", line)
+		}
+		hash := fields[0]
+		if fields[1] != "" {
+			hash = fields[1]
+		}
+		refs[fields[2]] = hash
+	}
+	return refs, nil
+}
+
+func (g git) log(revs ...string) (string, error) {
+	ctx, cancel := opContext("git.log")
+	defer cancel()
+	return g.cli().run(ctx, g.gt.logCmd(revs...)...)
+}
+
+func (g git) commits(from, to string) ([]gitCommit, error) {
+	ctx, cancel := opContext("git.log")
+	defer cancel()
+	revrange := to
+	if from != "" {
+		revrange = from + ".." + to
+	}
+	out, err := g.cli().run(ctx, g.gt.commitLogCmd(revrange)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseCommitLog(out)
+}
+
+// parseCommitLog parses the output of git log --format=commitLogFormat.
+func parseCommitLog(out string) ([]gitCommit, error) {
+	var commits []gitCommit
+	for _, rec := range strings.Split(out, "\x1e") {
+		rec = strings.TrimLeft(rec, "\n")
+		if rec == "" {
+			continue
+		}
+		fields := strings.SplitN(rec, "\x00", 9)
+		if len(fields) != 9 {
+			return nil, fmt.Errorf("unexpected git log record %q", rec)
+		}
+		authorTime, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected author time in git log record %q: %v", rec, err)
+		}
+		committerTime, err := strconv.ParseInt(fields[7], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected committer time in git log record %q: %v", rec, err)
+		}
+		commits = append(commits, gitCommit{
+			Hash:      fields[0],
+			Parents:   strings.Fields(fields[1]),
+			Author:    gitSignature{Name: fields[2], Email: fields[3], When: time.Unix(authorTime, 0)},
+			Committer: gitSignature{Name: fields[5], Email: fields[6], When: time.Unix(committerTime, 0)},
+			Message:   fields[8],
+		})
+	}
+	return commits, nil
+}
+
+func (g git) show(rev, path string) (string, error) {
+	ctx, cancel := opContext("git.show")
+	defer cancel()
+	return g.cli().run(ctx, g.gt.showCmd(rev, path)...)
+}
+
+func (g git) diff(from, to string) ([]fileDiff, error) {
+	ctx, cancel := opContext("git.diff")
+	defer cancel()
+	out, err := g.cli().run(ctx, g.gt.diffCmd(from, to)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseDiff(out)
+}
+
+// parseDiff splits the output of git diff --no-renames into per-file diffs.
+func parseDiff(out string) ([]fileDiff, error) {
+	var diffs []fileDiff
+	for _, chunk := range strings.SplitAfter(out, "\n") {
+		if strings.HasPrefix(chunk, "diff --git ") {
+			header := strings.TrimSpace(strings.TrimPrefix(chunk, "diff --git "))
+			i := strings.Index(header, " b/")
+			if !strings.HasPrefix(header, "a/") || i < 0 {
+				return nil, fmt.Errorf("unexpected git diff header %q", chunk)
+			}
+			diffs = append(diffs, fileDiff{Path: header[i+3:], Status: "M"})
+		}
+		if len(diffs) == 0 {
+			if strings.TrimSpace(chunk) != "" {
+				return nil, fmt.Errorf("unexpected git diff output %q", chunk)
+			}
+			continue
+		}
+		d := &diffs[len(diffs)-1]
+		switch {
+		case strings.HasPrefix(chunk, "new file mode"):
+			d.Status = "A"
+		case strings.HasPrefix(chunk, "deleted file mode"):
+			d.Status = "D"
+		}
+		d.Patch += chunk
+	}
+	return diffs, nil
+}
+
+func (g git) checkout(branch string) error {
+	ctx, cancel := opContext("git.checkout")
+	defer cancel()
+	_, err := g.cli().run(ctx, g.gt.checkoutCmd(branch)...)
+	return err
+}
+
+func (g git) createBranch(branch, rev string) error {
+	ctx, cancel := opContext("git.branch")
+	defer cancel()
+	_, err := g.cli().run(ctx, g.gt.branchCmd(branch, rev)...)
+	return err
 }
 
-func (g git) revlist(args ...string) (string, error) {
-	return g.cli().run(context.Background(), g.gt.revlistCmd(args...)...)
+func (g git) reset(rev string) error {
+	ctx, cancel := opContext("git.reset")
+	defer cancel()
+	_, err := g.cli().run(ctx, g.gt.resetCmd(rev)...)
+	return err
 }
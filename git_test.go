@@ -0,0 +1,214 @@
+package test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseForEachRef(t *testing.T) {
+	// The peeled hash is empty for everything but annotated tags.
+	out := "1111  refs/heads/master\n" +
+		"2222 3333 refs/tags/flux-sync\n" +
+		"4444  refs/tags/lightweight\n"
+	refs, err := parseForEachRef(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"refs/heads/master":     "1111",
+		"refs/tags/flux-sync":   "3333",
+		"refs/tags/lightweight": "4444",
+	}
+	for name, hash := range want {
+		if refs[name] != hash {
+			t.Errorf("refs[%q] = %q, want %q", name, refs[name], hash)
+		}
+	}
+	if len(refs) != len(want) {
+		t.Errorf("got %d refs, want %d", len(refs), len(want))
+	}
+}
+
+func TestParseCommitLog(t *testing.T) {
+	out := "2222\x001111\x00Weave Flux\x00support@weave.works\x001500000001\x00" +
+		"Weave Flux\x00support@weave.works\x001500000002\x00Auto-release image\n\nbody\n\x1e\n" +
+		"1111\x00\x00flux-test\x00flux-test@example.com\x001500000000\x00" +
+		"flux-test\x00flux-test@example.com\x001500000000\x00deploy\n\x1e\n"
+	commits, err := parseCommitLog(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("got %d commits, want 2: %+v", len(commits), commits)
+	}
+	c := commits[0]
+	if c.Hash != "2222" || len(c.Parents) != 1 || c.Parents[0] != "1111" {
+		t.Errorf("first commit = %+v, want hash 2222 with parent 1111", c)
+	}
+	if c.Committer.Email != "support@weave.works" || c.Committer.When.Unix() != 1500000002 {
+		t.Errorf("first commit committer = %+v", c.Committer)
+	}
+	if c.Message != "Auto-release image\n\nbody\n" {
+		t.Errorf("first commit message = %q", c.Message)
+	}
+	if len(commits[1].Parents) != 0 {
+		t.Errorf("root commit has parents %v", commits[1].Parents)
+	}
+
+	if _, err := parseCommitLog("garbage\x1e"); err == nil {
+		t.Errorf("parseCommitLog accepted garbage")
+	}
+}
+
+func TestParseDiff(t *testing.T) {
+	out := `diff --git a/added.yaml b/added.yaml
+new file mode 100644
+index 0000000..d00491f
+--- /dev/null
++++ b/added.yaml
+@@ -0,0 +1 @@
++a: 1
+diff --git a/dir/changed.yaml b/dir/changed.yaml
+index d00491f..0cfbf08 100644
+--- a/dir/changed.yaml
++++ b/dir/changed.yaml
+@@ -1 +1 @@
+-image: foo:1
++image: foo:2
+diff --git a/gone.yaml b/gone.yaml
+deleted file mode 100644
+index d00491f..0000000
+--- a/gone.yaml
++++ /dev/null
+@@ -1 +0,0 @@
+-a: 1
+`
+	diffs, err := parseDiff(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ path, status string }{
+		{"added.yaml", "A"}, {"dir/changed.yaml", "M"}, {"gone.yaml", "D"},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("got %d diffs, want %d: %+v", len(diffs), len(want), diffs)
+	}
+	for i, w := range want {
+		if diffs[i].Path != w.path || diffs[i].Status != w.status {
+			t.Errorf("diff %d = %s %s, want %s %s", i, diffs[i].Status, diffs[i].Path, w.status, w.path)
+		}
+	}
+	if !strings.Contains(diffs[1].Patch, "+image: foo:2") {
+		t.Errorf("patch for changed.yaml is missing the change: %q", diffs[1].Patch)
+	}
+
+	if diffs, err := parseDiff(""); err != nil || len(diffs) != 0 {
+		t.Errorf("parseDiff(\"\") = %v, %v; want no diffs", diffs, err)
+	}
+}
+
+func TestGitFetchMovedTag(t *testing.T) {
+	bin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := filepath.Join(dir, "origin.git")
+	if out, err := exec.Command(bin, "init", "--bare", origin).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	lg := newTestLogger(t)
+	// flux moves the sync tag in its clone; the test fetches it in another.
+	flux := mustNewGit(lg, bin, filepath.Join(dir, "flux"), nil, origin, "master")
+	g := mustNewGit(lg, bin, filepath.Join(dir, "clone"), nil, origin, "master")
+
+	commitTag := func(content string) string {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(flux.gt.repodir, "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := flux.addCommit(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := flux.push("master"); err != nil {
+			t.Fatal(err)
+		}
+		if err := flux.pushTag("flux-sync", hash); err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	for _, content := range []string{"one", "two"} {
+		hash := commitTag(content)
+		if err := g.fetch(); err != nil {
+			t.Fatalf("fetch after tagging %q: %v", content, err)
+		}
+		if got, err := g.resolve("flux-sync"); err != nil || got != hash {
+			t.Errorf("flux-sync after tagging %q = %q, %v; want %q", content, got, err, hash)
+		}
+	}
+}
+
+func TestGitPushRejected(t *testing.T) {
+	bin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := filepath.Join(dir, "origin.git")
+	if out, err := exec.Command(bin, "init", "--bare", origin).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	lg := newTestLogger(t)
+	clones := []git{
+		mustNewGit(lg, bin, filepath.Join(dir, "one"), nil, origin, "master"),
+		mustNewGit(lg, bin, filepath.Join(dir, "two"), nil, origin, "master"),
+	}
+	var errs []error
+	for i, g := range clones {
+		if err := ioutil.WriteFile(filepath.Join(g.gt.repodir, "file"), []byte{byte('a' + i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.addCommit("edit"); err != nil {
+			t.Fatal(err)
+		}
+		errs = append(errs, g.push("master"))
+	}
+	if errs[0] != nil {
+		t.Fatalf("first push: %v", errs[0])
+	}
+	if !pushRejected(errs[1]) {
+		t.Errorf("pushRejected(%v) = false for a push behind upstream", errs[1])
+	}
+
+	// Failures that retrying won't fix aren't rejections; go-git reports
+	// rejections as non-fast-forward updates.
+	for _, err := range []error{
+		nil,
+		errors.New("fatal: Authentication failed for 'https://example.com/repo.git/'"),
+		errors.New("ssh: connect to host example.com port 22: Connection refused"),
+		errors.New("non-fast-forward update: refs/heads/master"),
+	} {
+		want := err != nil && strings.HasPrefix(err.Error(), "non-fast-forward")
+		if got := pushRejected(err); got != want {
+			t.Errorf("pushRejected(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie"
+)
+
+type (
+	// nativeGit implements gitAPI in-process using go-git, so that it
+	// doesn't depend on the host's git and polling doesn't fork.  Each
+	// gitAPI operation is run as the pseudo-command go-git, so it's
+	// audited, retried and recorded or replayed like the git binary.
+	nativeGit struct {
+		repodir      string
+		gitOriginURL string
+		// branch is the upstream branch mustAddCommitPush pushes to.
+		branch string
+		auth   transport.AuthMethod
+		repo   *gogit.Repository
+		lg     logger
+	}
+)
+
+// gitDateFormat is the date format git log uses by default.
+const gitDateFormat = "Mon Jan 2 15:04:05 2006 -0700"
+
+var (
+	fetchRefSpecs = []config.RefSpec{
+		"+refs/heads/*:refs/remotes/origin/*",
+		"+refs/tags/*:refs/tags/*",
+	}
+)
+
+// sshAuth returns the auth method for connecting over ssh with the given
+// private key, checking the server against knownHosts.
+func sshAuth(keyPath string, knownHosts string) (transport.AuthMethod, error) {
+	auth, err := ssh.NewPublicKeysFromFile("git", keyPath, "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to load ssh key %s: %v", keyPath, err)
+	}
+	auth.HostKeyCallback, err = ssh.NewKnownHostsCallback(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load known hosts %s: %v", knownHosts, err)
+	}
+	return auth, nil
+}
+
+// mustNewNativeGit clones origin into repodir.  An empty origin results in
+// a fresh repo with origin as its remote, as git clone would.
+func mustNewNativeGit(lg logger, repodir string, auth transport.AuthMethod, origin string, branch string) *nativeGit {
+	if _, err := os.Stat(repodir); err == nil || !os.IsNotExist(err) {
+		lg.Fatalf("git repodir %s must not already exist", repodir)
+	}
+
+	lg = withFields(lg, "tool", "go-git")
+	g := &nativeGit{repodir: repodir, gitOriginURL: origin, branch: branch, auth: auth, lg: lg}
+	_, err := g.run("git.clone", func(ctx context.Context) (string, error) {
+		repo, err := gogit.PlainCloneContext(ctx, repodir, false, &gogit.CloneOptions{URL: origin, Auth: auth})
+		if err == transport.ErrEmptyRemoteRepository {
+			lg.Logf("git clone %q: remote is empty, initializing", secrets.redact(origin))
+			repo, err = gogit.PlainInit(repodir, false)
+			if err == nil {
+				_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{origin}})
+			}
+		}
+		if err != nil {
+			// Leave nothing behind to stop a retry cloning afresh.
+			os.RemoveAll(repodir)
+			return "", err
+		}
+		g.repo = repo
+		return "", nil
+	}, "clone", origin, repodir)
+	if err != nil {
+		lg.Fatalf("Unable to clone %q: %v", secrets.redact(origin), err)
+	}
+	lg.Logf("git clone %q done", secrets.redact(origin))
+	return g
+}
+
+// run performs f as the pseudo-command go-git with the given args, within
+// the timeout for op.  When replaying transcripts f isn't called, and
+// g.repo may be nil.
+func (g *nativeGit) run(op string, f func(ctx context.Context) (string, error), args ...string) (string, error) {
+	ctx, cancel := opContext(op)
+	defer cancel()
+	return runInProcess(ctx, g.lg, f, append([]string{"go-git"}, args...)...)
+}
+
+// runJSON is like run, but for operations with structured results, which
+// are decoded into v.
+func (g *nativeGit) runJSON(op string, v interface{}, f func() (interface{}, error), args ...string) error {
+	ctx, cancel := opContext(op)
+	defer cancel()
+	return runInProcessJSON(ctx, g.lg, v, func(context.Context) (interface{}, error) {
+		return f()
+	}, append([]string{"go-git"}, args...)...)
+}
+
+// origin returns the origin URL, fit for logging.
+func (g *nativeGit) origin() string {
+	return secrets.redact(g.gitOriginURL)
+}
+
+// httpsTransport is go-git's transport for https remotes.  It verifies
+// server certificates, except for the hosts given to skipTLSVerify.
+var (
+	httpsTransport        = newSkipVerifyTransport()
+	installHTTPSTransport sync.Once
+)
+
+// skipVerifyTransport sends requests to the hosts in skip without verifying
+// their certificates, and all others with verification.
+type skipVerifyTransport struct {
+	mu       sync.Mutex
+	skip     map[string]bool
+	verify   http.RoundTripper
+	insecure http.RoundTripper
+}
+
+func newSkipVerifyTransport() *skipVerifyTransport {
+	return &skipVerifyTransport{
+		skip:   make(map[string]bool),
+		verify: http.DefaultTransport,
+		insecure: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// skipHost stops verifying the certificate of host, given as host:port.
+func (t *skipVerifyTransport) skipHost(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.skip[host] = true
+}
+
+func (t *skipVerifyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	skip := t.skip[req.URL.Host]
+	t.mu.Unlock()
+	if skip {
+		return t.insecure.RoundTrip(req)
+	}
+	return t.verify.RoundTrip(req)
+}
+
+// skipTLSVerify makes go-git accept any certificate from the https git
+// server at host, given as host:port, for use with a git server using a
+// self-signed certificate.  Other servers' certificates are still verified.
+func skipTLSVerify(host string) {
+	installHTTPSTransport.Do(func() {
+		client.InstallProtocol("https", githttp.NewClient(&http.Client{Transport: httpsTransport}))
+	})
+	httpsTransport.skipHost(host)
+}
+
+func (g *nativeGit) fetch() error {
+	_, err := g.run("git.fetch", func(ctx context.Context) (string, error) {
+		err := g.repo.FetchContext(ctx, &gogit.FetchOptions{RefSpecs: fetchRefSpecs, Auth: g.auth, Force: true})
+		if err != nil && err != gogit.NoErrAlreadyUpToDate {
+			return "", fmt.Errorf("Unable to fetch from %q: %v", g.origin(), err)
+		}
+		debugf(g.lg, "git fetch %q: %v", g.origin(), err)
+		return "", nil
+	}, "fetch", "--force", "origin")
+	return err
+}
+
+func (g *nativeGit) mustFetch() {
+	if err := g.fetch(); err != nil {
+		g.lg.Fatalf("%v", err)
+	}
+}
+
+func (g *nativeGit) mustAddCommitPush() {
+	hash, err := g.addCommit("deploy")
+	if err != nil {
+		g.lg.Fatalf("%v", err)
+	}
+	if err := g.push(g.branch); err != nil {
+		g.lg.Fatalf("%v", err)
+	}
+	g.lg.Logf("git pushed %s to %s of %q", hash, g.branch, g.origin())
+}
+
+// addCommit stages every change in the worktree, like git add -A, and
+// commits it.
+func (g *nativeGit) addCommit(msg string) (string, error) {
+	return g.run("git.commit", func(context.Context) (string, error) {
+		wt, err := g.stageAll()
+		if err != nil {
+			return "", err
+		}
+		hash, err := wt.Commit(msg, &gogit.CommitOptions{Author: testSignature()})
+		if err != nil {
+			return "", fmt.Errorf("Unable to commit: %v", err)
+		}
+		return hash.String(), nil
+	}, "commit", "--all", "-m", msg)
+}
+
+// stageAll stages every change in the worktree, failing if there are none.
+func (g *nativeGit) stageAll() (*gogit.Worktree, error) {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get worktree status: %v", err)
+	}
+	if status.IsClean() {
+		return nil, fmt.Errorf("Unable to commit: nothing to commit")
+	}
+	for path, st := range status {
+		if st.Worktree == gogit.Deleted {
+			_, err = wt.Remove(path)
+		} else {
+			_, err = wt.Add(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to stage %s: %v", path, err)
+		}
+	}
+	return wt, nil
+}
+
+// amend replaces HEAD with a commit of its changes plus those in the
+// worktree, as git commit --amend would.  go-git has no amend, so the new
+// commit is given HEAD's parents explicitly.
+func (g *nativeGit) amend(msg string) (string, error) {
+	return g.run("git.commit", func(context.Context) (string, error) {
+		head, err := g.commit("HEAD")
+		if err != nil {
+			return "", err
+		}
+		if head.NumParents() == 0 {
+			return "", fmt.Errorf("Unable to amend the root commit %s", head.Hash)
+		}
+		wt, err := g.stageAll()
+		if err != nil {
+			return "", err
+		}
+		hash, err := wt.Commit(msg, &gogit.CommitOptions{Author: testSignature(), Parents: head.ParentHashes})
+		if err != nil {
+			return "", fmt.Errorf("Unable to amend: %v", err)
+		}
+		return hash.String(), nil
+	}, "commit", "--all", "--amend", "-m", msg)
+}
+
+// push pushes the current local branch to the given upstream branch.
+func (g *nativeGit) push(branch string) error {
+	return g.pushBranch(branch, "")
+}
+
+func (g *nativeGit) forcePush(branch string) error {
+	return g.pushBranch(branch, "+")
+}
+
+func (g *nativeGit) pushBranch(branch string, force string) error {
+	args := []string{"push", "origin", "HEAD:" + plumbing.NewBranchReferenceName(branch).String()}
+	if force != "" {
+		args = append(args, "--force")
+	}
+	_, err := g.run("git.push", func(ctx context.Context) (string, error) {
+		head, err := g.repo.Head()
+		if err != nil {
+			return "", fmt.Errorf("Unable to push: %v", err)
+		}
+		if !head.Name().IsBranch() {
+			return "", fmt.Errorf("Unable to push: HEAD is not a branch")
+		}
+		return "", g.pushRefSpec(ctx, config.RefSpec(force+head.Name().String()+":"+
+			plumbing.NewBranchReferenceName(branch).String()))
+	}, args...)
+	return err
+}
+
+func (g *nativeGit) pushRefSpec(ctx context.Context, refspec config.RefSpec) error {
+	err := g.repo.PushContext(ctx, &gogit.PushOptions{RefSpecs: []config.RefSpec{refspec}, Auth: g.auth})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return fmt.Errorf("Unable to push %s to %q: %v", refspec, g.origin(), err)
+	}
+	return nil
+}
+
+func (g *nativeGit) pushTag(name, rev string) error {
+	_, err := g.run("git.push", func(ctx context.Context) (string, error) {
+		c, err := g.commit(rev)
+		if err != nil {
+			return "", err
+		}
+		ref := plumbing.NewTagReferenceName(name)
+		if err := g.repo.Storer.SetReference(plumbing.NewHashReference(ref, c.Hash)); err != nil {
+			return "", fmt.Errorf("Unable to tag %s as %q: %v", c.Hash, name, err)
+		}
+		return "", g.pushRefSpec(ctx, config.RefSpec("+"+ref.String()+":"+ref.String()))
+	}, "push-tag", name, rev)
+	return err
+}
+
+func (g *nativeGit) deleteTag(name string) error {
+	_, err := g.run("git.push", func(ctx context.Context) (string, error) {
+		ref := plumbing.NewTagReferenceName(name)
+		if err := g.pushRefSpec(ctx, config.RefSpec(":"+ref.String())); err != nil {
+			return "", err
+		}
+		if err := g.repo.Storer.RemoveReference(ref); err != nil {
+			return "", fmt.Errorf("Unable to delete tag %q: %v", name, err)
+		}
+		return "", nil
+	}, "delete-tag", name)
+	return err
+}
+
+func testSignature() *object.Signature {
+	return &object.Signature{Name: "flux-test", Email: "flux-test@example.com", When: time.Now()}
+}
+
+func (g *nativeGit) resolve(rev string) (string, error) {
+	return g.run("git.rev-parse", func(context.Context) (string, error) {
+		hash, err := g.repo.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return "", fmt.Errorf("Unable to resolve %q: %v", rev, err)
+		}
+		return hash.String(), nil
+	}, "rev-parse", rev)
+}
+
+// ancestors returns the set of commits reachable from rev.
+func (g *nativeGit) ancestors(rev string) (map[plumbing.Hash]*object.Commit, error) {
+	hash, err := g.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve %q: %v", rev, err)
+	}
+	iter, err := g.repo.Log(&gogit.LogOptions{From: *hash})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to walk history of %q: %v", rev, err)
+	}
+	commits := make(map[plumbing.Hash]*object.Commit)
+	err = iter.ForEach(func(c *object.Commit) error {
+		commits[c.Hash] = c
+		return nil
+	})
+	return commits, err
+}
+
+func (g *nativeGit) countCommits(from, to string) (int, error) {
+	out, err := g.run("git.rev-list", func(context.Context) (string, error) {
+		fromSet, err := g.ancestors(from)
+		if err != nil {
+			return "", err
+		}
+		toSet, err := g.ancestors(to)
+		if err != nil {
+			return "", err
+		}
+		count := 0
+		for hash := range toSet {
+			if _, ok := fromSet[hash]; !ok {
+				count++
+			}
+		}
+		return strconv.Itoa(count), nil
+	}, "rev-list", "--count", from+".."+to)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(out)
+}
+
+func (g *nativeGit) refs() (map[string]string, error) {
+	var refs map[string]string
+	err := g.runJSON("git.show-ref", &refs, func() (interface{}, error) {
+		iter, err := g.repo.References()
+		if err != nil {
+			return nil, err
+		}
+		refs := make(map[string]string)
+		err = iter.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Type() != plumbing.HashReference {
+				return nil
+			}
+			hash, err := g.repo.ResolveRevision(plumbing.Revision(ref.Name()))
+			if err != nil {
+				return nil
+			}
+			refs[ref.Name().String()] = hash.String()
+			return nil
+		})
+		return refs, err
+	}, "show-ref")
+	return refs, err
+}
+
+// log approximates git log --format=fuller for the commits reachable from
+// any of revs, newest first.
+func (g *nativeGit) log(revs ...string) (string, error) {
+	return g.run("git.log", func(context.Context) (string, error) {
+		return g.fullerLog(revs)
+	}, append([]string{"log", "--format=fuller"}, revs...)...)
+}
+
+func (g *nativeGit) fullerLog(revs []string) (string, error) {
+	all := make(map[plumbing.Hash]*object.Commit)
+	for _, rev := range revs {
+		commits, err := g.ancestors(rev)
+		if err != nil {
+			return "", err
+		}
+		for hash, c := range commits {
+			all[hash] = c
+		}
+	}
+	var b bytes.Buffer
+	for _, c := range topoOrder(all) {
+		fmt.Fprintf(&b, "commit %s\n", c.Hash)
+		fmt.Fprintf(&b, "Author:     %s <%s>\n", c.Author.Name, c.Author.Email)
+		fmt.Fprintf(&b, "AuthorDate: %s\n", c.Author.When.Format(gitDateFormat))
+		fmt.Fprintf(&b, "Commit:     %s <%s>\n", c.Committer.Name, c.Committer.Email)
+		fmt.Fprintf(&b, "CommitDate: %s\n\n", c.Committer.When.Format(gitDateFormat))
+		for _, line := range strings.Split(strings.TrimRight(c.Message, "\n"), "\n") {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+func (g *nativeGit) commit(rev string) (*object.Commit, error) {
+	hash, err := g.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve %q: %v", rev, err)
+	}
+	return g.repo.CommitObject(*hash)
+}
+
+func (g *nativeGit) commits(from, to string) ([]gitCommit, error) {
+	var commits []gitCommit
+	err := g.runJSON("git.log", &commits, func() (interface{}, error) {
+		return g.commitRange(from, to)
+	}, "log", "--topo-order", from+".."+to)
+	return commits, err
+}
+
+func (g *nativeGit) commitRange(from, to string) ([]gitCommit, error) {
+	exclude := map[plumbing.Hash]*object.Commit{}
+	if from != "" {
+		var err error
+		if exclude, err = g.ancestors(from); err != nil {
+			return nil, err
+		}
+	}
+	included, err := g.ancestors(to)
+	if err != nil {
+		return nil, err
+	}
+	for hash := range exclude {
+		delete(included, hash)
+	}
+	var commits []gitCommit
+	for _, c := range topoOrder(included) {
+		gc := gitCommit{
+			Hash:      c.Hash.String(),
+			Author:    gitSignature{Name: c.Author.Name, Email: c.Author.Email, When: c.Author.When},
+			Committer: gitSignature{Name: c.Committer.Name, Email: c.Committer.Email, When: c.Committer.When},
+			Message:   c.Message,
+		}
+		for _, p := range c.ParentHashes {
+			gc.Parents = append(gc.Parents, p.String())
+		}
+		commits = append(commits, gc)
+	}
+	return commits, nil
+}
+
+// topoOrder returns commits newest first, with every commit before its
+// parents, as git log --topo-order does.  Commit times only have one-second
+// resolution, so they're used just to order commits unrelated by ancestry.
+func topoOrder(commits map[plumbing.Hash]*object.Commit) []*object.Commit {
+	children := make(map[plumbing.Hash]int)
+	for _, c := range commits {
+		for _, p := range c.ParentHashes {
+			if _, ok := commits[p]; ok {
+				children[p]++
+			}
+		}
+	}
+	var ready, ordered []*object.Commit
+	for hash, c := range commits {
+		if children[hash] == 0 {
+			ready = append(ready, c)
+		}
+	}
+	for len(ready) > 0 {
+		// Take the newest commit none of whose children remain.
+		sort.Slice(ready, func(i, j int) bool {
+			ti, tj := ready[i].Committer.When, ready[j].Committer.When
+			if !ti.Equal(tj) {
+				return ti.Before(tj)
+			}
+			return ready[i].Hash.String() < ready[j].Hash.String()
+		})
+		c := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		ordered = append(ordered, c)
+		for _, p := range c.ParentHashes {
+			if _, ok := commits[p]; !ok {
+				continue
+			}
+			if children[p]--; children[p] == 0 {
+				ready = append(ready, commits[p])
+			}
+		}
+	}
+	return ordered
+}
+
+func (g *nativeGit) show(rev, path string) (string, error) {
+	return g.run("git.show", func(context.Context) (string, error) {
+		c, err := g.commit(rev)
+		if err != nil {
+			return "", err
+		}
+		f, err := c.File(path)
+		if err != nil {
+			return "", fmt.Errorf("Unable to find %s in %q: %v", path, rev, err)
+		}
+		return f.Contents()
+	}, "show", rev+":"+path)
+}
+
+func (g *nativeGit) diff(from, to string) ([]fileDiff, error) {
+	var diffs []fileDiff
+	err := g.runJSON("git.diff", &diffs, func() (interface{}, error) {
+		return g.treeDiff(from, to)
+	}, "diff", from, to)
+	return diffs, err
+}
+
+func (g *nativeGit) treeDiff(from, to string) ([]fileDiff, error) {
+	var trees []*object.Tree
+	for _, rev := range []string{from, to} {
+		c, err := g.commit(rev)
+		if err != nil {
+			return nil, err
+		}
+		tree, err := c.Tree()
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, tree)
+	}
+	changes, err := trees[0].Diff(trees[1])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to diff %q and %q: %v", from, to, err)
+	}
+	var diffs []fileDiff
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, err
+		}
+		patch, err := change.Patch()
+		if err != nil {
+			return nil, err
+		}
+		d := fileDiff{Path: change.To.Name, Status: "M", Patch: patch.String()}
+		switch action {
+		case merkletrie.Insert:
+			d.Status = "A"
+		case merkletrie.Delete:
+			d.Path, d.Status = change.From.Name, "D"
+		}
+		diffs = append(diffs, d)
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs, nil
+}
+
+func (g *nativeGit) checkout(branch string) error {
+	_, err := g.run("git.checkout", func(context.Context) (string, error) {
+		wt, err := g.repo.Worktree()
+		if err != nil {
+			return "", err
+		}
+		err = wt.Checkout(&gogit.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch)})
+		if err != nil {
+			return "", fmt.Errorf("Unable to check out %q: %v", branch, err)
+		}
+		return "", nil
+	}, "checkout", branch)
+	return err
+}
+
+func (g *nativeGit) createBranch(branch, rev string) error {
+	_, err := g.run("git.branch", func(context.Context) (string, error) {
+		c, err := g.commit(rev)
+		if err != nil {
+			return "", err
+		}
+		name := plumbing.NewBranchReferenceName(branch)
+		if _, err := g.repo.Reference(name, false); err == nil {
+			return "", fmt.Errorf("Unable to create branch %q: it already exists", branch)
+		}
+		if err := g.repo.Storer.SetReference(plumbing.NewHashReference(name, c.Hash)); err != nil {
+			return "", fmt.Errorf("Unable to create branch %q: %v", branch, err)
+		}
+		return "", nil
+	}, "branch", branch, rev)
+	return err
+}
+
+func (g *nativeGit) reset(rev string) error {
+	_, err := g.run("git.reset", func(context.Context) (string, error) {
+		c, err := g.commit(rev)
+		if err != nil {
+			return "", err
+		}
+		wt, err := g.repo.Worktree()
+		if err != nil {
+			return "", err
+		}
+		if err := wt.Reset(&gogit.ResetOptions{Commit: c.Hash, Mode: gogit.HardReset}); err != nil {
+			return "", fmt.Errorf("Unable to reset to %q: %v", rev, err)
+		}
+		return "", nil
+	}, "reset", "--hard", rev)
+	return err
+}
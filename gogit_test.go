@@ -0,0 +1,484 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+)
+
+func init() {
+	// Serve file:// URLs in-process rather than via git-upload-pack, so
+	// these tests don't need git installed.
+	client.InstallProtocol("file", server.NewClient(server.DefaultLoader))
+}
+
+func TestNativeGit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := filepath.Join(dir, "origin.git")
+	if _, err := gogit.PlainInit(origin, true); err != nil {
+		t.Fatal(err)
+	}
+	lg := newTestLogger(t)
+	g := mustNewNativeGit(lg, filepath.Join(dir, "clone"), nil, "file://"+origin, "master")
+
+	commit := func(file, content string) string {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(g.repodir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		g.mustAddCommitPush()
+		rev, err := g.resolve("HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+	first := commit("a.yaml", "a: 1\n")
+	second := commit("b.yaml", "b: 1\n")
+
+	// A second clone sees both commits after fetching.
+	other := mustNewNativeGit(lg, filepath.Join(dir, "other"), nil, "file://"+origin, "master")
+	other.mustFetch()
+	if rev, err := other.resolve("origin/master"); err != nil || rev != second {
+		t.Errorf("resolve(origin/master) = %q, %v; want %q", rev, err, second)
+	}
+	if count, err := other.countCommits(first, "origin/master"); err != nil || count != 1 {
+		t.Errorf("countCommits(first, origin/master) = %d, %v; want 1", count, err)
+	}
+	if count, err := other.countCommits("origin/master", first); err != nil || count != 0 {
+		t.Errorf("countCommits(origin/master, first) = %d, %v; want 0", count, err)
+	}
+
+	refs, err := other.refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs["refs/remotes/origin/master"] != second {
+		t.Errorf("refs() = %v, want refs/remotes/origin/master at %s", refs, second)
+	}
+
+	// Deleting a file is committed too.
+	if err := os.Remove(filepath.Join(g.repodir, "a.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	g.mustAddCommitPush()
+	other.mustFetch()
+	if count, err := other.countCommits(second, "origin/master"); err != nil || count != 1 {
+		t.Errorf("countCommits after delete = %d, %v; want 1", count, err)
+	}
+	if _, err := other.resolve("no-such-rev"); err == nil {
+		t.Errorf("resolve(no-such-rev) succeeded")
+	}
+
+	// Pushing to another branch leaves master alone.
+	if err := ioutil.WriteFile(filepath.Join(g.repodir, "c.yaml"), []byte("c: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	third, err := g.addCommit("third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.push("deploy"); err != nil {
+		t.Fatal(err)
+	}
+	other.mustFetch()
+	if rev, err := other.resolve("origin/deploy"); err != nil || rev != third {
+		t.Errorf("resolve(origin/deploy) = %q, %v; want %q", rev, err, third)
+	}
+	if count, err := other.countCommits("origin/deploy", "origin/master"); err != nil || count != 0 {
+		t.Errorf("countCommits(origin/deploy, origin/master) = %d, %v; want 0", count, err)
+	}
+	if count, err := other.countCommits("origin/master", "origin/deploy"); err != nil || count != 1 {
+		t.Errorf("countCommits(origin/master, origin/deploy) = %d, %v; want 1", count, err)
+	}
+}
+
+func TestNativeGitHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := filepath.Join(dir, "origin.git")
+	if _, err := gogit.PlainInit(origin, true); err != nil {
+		t.Fatal(err)
+	}
+	g := mustNewNativeGit(newTestLogger(t), filepath.Join(dir, "clone"), nil, "file://"+origin, "master")
+	write := func(file, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(g.repodir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a.yaml", "image: foo:1\n")
+	write("b.yaml", "b: 1\n")
+	g.mustAddCommitPush()
+	first, _ := g.resolve("HEAD")
+	write("a.yaml", "image: foo:2\n")
+	write("c.yaml", "c: 1\n")
+	if err := os.Remove(filepath.Join(g.repodir, "b.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	g.mustAddCommitPush()
+	second, _ := g.resolve("HEAD")
+
+	commits, err := g.commits(first, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0].Hash != second || commits[0].Parents[0] != first {
+		t.Errorf("commits(first, HEAD) = %+v, want just %s", commits, second)
+	}
+	if c := commits[0]; c.Committer.Email != "flux-test@example.com" || c.Message != "deploy" {
+		t.Errorf("commit = %+v, want committed by flux-test with message deploy", c)
+	}
+	if commits, _ := g.commits("", "HEAD"); len(commits) != 2 {
+		t.Errorf("commits(\"\", HEAD) returned %d commits, want 2", len(commits))
+	}
+
+	if content, err := g.show(first, "a.yaml"); err != nil || content != "image: foo:1\n" {
+		t.Errorf("show(first, a.yaml) = %q, %v", content, err)
+	}
+	if _, err := g.show(second, "b.yaml"); err == nil {
+		t.Errorf("show(second, b.yaml) found a deleted file")
+	}
+
+	diffs, err := g.diff(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.Status+" "+d.Path)
+	}
+	if want := []string{"M a.yaml", "D b.yaml", "A c.yaml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("diff(first, second) = %v, want %v", got, want)
+	}
+	if !strings.Contains(diffs[0].Patch, "+image: foo:2") {
+		t.Errorf("patch for a.yaml is missing the change: %q", diffs[0].Patch)
+	}
+
+	if err := g.createBranch("old", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.createBranch("old", second); err == nil {
+		t.Errorf("createBranch succeeded for an existing branch")
+	}
+	if err := g.checkout("old"); err != nil {
+		t.Fatal(err)
+	}
+	if rev, _ := g.resolve("HEAD"); rev != first {
+		t.Errorf("HEAD after checkout is %s, want %s", rev, first)
+	}
+	if err := g.reset(second); err != nil {
+		t.Fatal(err)
+	}
+	if rev, _ := g.resolve("old"); rev != second {
+		t.Errorf("old after reset is %s, want %s", rev, second)
+	}
+	if _, err := os.Stat(filepath.Join(g.repodir, "c.yaml")); err != nil {
+		t.Errorf("worktree not reset: %v", err)
+	}
+}
+
+func TestNativeGitRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := filepath.Join(dir, "origin.git")
+	if _, err := gogit.PlainInit(origin, true); err != nil {
+		t.Fatal(err)
+	}
+	lg := newTestLogger(t)
+	g := mustNewNativeGit(lg, filepath.Join(dir, "clone"), nil, "file://"+origin, "master")
+	write := func(file, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(g.repodir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upstream := func() map[string]string {
+		t.Helper()
+		other := mustNewNativeGit(lg, filepath.Join(dir, "other"), nil, "file://"+origin, "master")
+		defer os.RemoveAll(other.repodir)
+		refs, err := other.refs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return refs
+	}
+
+	write("a.yaml", "a: 1\n")
+	g.mustAddCommitPush()
+	first, _ := g.resolve("HEAD")
+	write("b.yaml", "b: 1\n")
+	g.mustAddCommitPush()
+
+	write("b.yaml", "b: 2\n")
+	amended, err := g.amend("amended")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := g.commits(first, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0].Hash != amended || commits[0].Message != "amended" {
+		t.Errorf("commits after amend = %+v, want just %s", commits, amended)
+	}
+	if err := g.push("master"); err == nil {
+		t.Errorf("push of amended commit succeeded without force")
+	}
+	if err := g.forcePush("master"); err != nil {
+		t.Fatal(err)
+	}
+	if refs := upstream(); refs["refs/remotes/origin/master"] != amended {
+		t.Errorf("upstream master = %s after force push, want %s", refs["refs/remotes/origin/master"], amended)
+	}
+
+	if err := g.pushTag("flux-sync", amended); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.pushTag("flux-sync", first); err != nil {
+		t.Fatal(err)
+	}
+	if refs := upstream(); refs["refs/tags/flux-sync"] != first {
+		t.Errorf("upstream flux-sync = %s after moving it, want %s", refs["refs/tags/flux-sync"], first)
+	}
+	// deleteTag isn't tested here: the in-process server can't handle the
+	// delete-only push it makes.
+}
+
+// TestNativeGitCommitOrder checks that commits made within the same second
+// are returned children first rather than in arbitrary order.
+func TestNativeGitCommitOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := filepath.Join(dir, "origin.git")
+	if _, err := gogit.PlainInit(origin, true); err != nil {
+		t.Fatal(err)
+	}
+	g := mustNewNativeGit(newTestLogger(t), filepath.Join(dir, "clone"), nil, "file://"+origin, "master")
+	sig := testSignature()
+	var want []string
+	for i := 0; i < 8; i++ {
+		file := fmt.Sprintf("f%d.yaml", i)
+		if err := ioutil.WriteFile(filepath.Join(g.repodir, file), []byte("a: 1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wt, err := g.stageAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := wt.Commit(file, &gogit.CommitOptions{Author: sig, Committer: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append([]string{hash.String()}, want...)
+	}
+
+	commits, err := g.commits("", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range commits {
+		got = append(got, c.Hash)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("commits(\"\", HEAD) = %v, want %v", got, want)
+	}
+
+	log, err := g.log("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, line := range strings.Split(log, "\n") {
+		if strings.HasPrefix(line, "commit ") {
+			got = append(got, strings.TrimPrefix(line, "commit "))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("log(HEAD) lists %v, want %v", got, want)
+	}
+}
+
+// TestNativeGitRecordReplay checks that go-git operations go through the
+// cli decorators: they're audited and recorded, and replay without a repo.
+func TestNativeGitRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	transcriptDir := filepath.Join(dir, "transcripts")
+	if err := os.Mkdir(transcriptDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	type results struct {
+		head, shown string
+		count       int
+		commits     []gitCommit
+		diffs       []fileDiff
+		resolveErr  bool
+	}
+	// session does the same operations whether recording or replaying;
+	// only when recording are there files to commit.
+	session := func(testroot string, recording bool) results {
+		t.Helper()
+		origin := filepath.Join(testroot, "origin.git")
+		if recording {
+			if _, err := gogit.PlainInit(origin, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		g := mustNewNativeGit(newTestLogger(t), filepath.Join(testroot, "clone"), nil, "file://"+origin, "master")
+		write := func(file, content string) {
+			if recording {
+				if err := ioutil.WriteFile(filepath.Join(g.repodir, file), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		write("a.yaml", "a: 1\n")
+		g.mustAddCommitPush()
+		first, err := g.resolve("HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		write("b.yaml", "b: 1\n")
+		g.mustAddCommitPush()
+		g.mustFetch()
+
+		var r results
+		if r.head, err = g.resolve("origin/master"); err != nil {
+			t.Fatal(err)
+		}
+		if r.shown, err = g.show(r.head, "b.yaml"); err != nil {
+			t.Fatal(err)
+		}
+		if r.count, err = g.countCommits(first, r.head); err != nil {
+			t.Fatal(err)
+		}
+		if r.commits, err = g.commits("", r.head); err != nil {
+			t.Fatal(err)
+		}
+		if r.diffs, err = g.diff(first, r.head); err != nil {
+			t.Fatal(err)
+		}
+		_, err = g.resolve("no-such-rev")
+		r.resolveErr = err != nil
+		return r
+	}
+
+	saved := cliDecorators
+	defer func() { cliDecorators = saved }()
+
+	recordRoot := filepath.Join(dir, "record")
+	rec, err := newTranscripts(transcriptDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.substitute(recordRoot, "${TESTROOT}")
+	audits, err := newAuditLogs(filepath.Join(dir, "audit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audits.close()
+	cliDecorators = []func(logger, []string, executor) executor{
+		audits.decorate, newRetryDecorator(defaultRetryRules), rec.decorate}
+	recorded := session(recordRoot, true)
+	if recorded.count != 1 || len(recorded.commits) != 2 || len(recorded.diffs) != 1 ||
+		recorded.shown != "b: 1\n" || !recorded.resolveErr {
+		t.Fatalf("unexpected results recording: %+v", recorded)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "audit", perTestFilename(t.Name(), ".jsonl")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"args":["go-git","clone"`, `"args":["go-git","fetch"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("audit log lacks %s:\n%s", want, b)
+		}
+	}
+
+	rep, err := newTranscripts(transcriptDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep.substitute(filepath.Join(dir, "replay"), "${TESTROOT}")
+	cliDecorators = []func(logger, []string, executor) executor{rep.decorate}
+	if replayed := session(filepath.Join(dir, "replay"), false); !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("replayed results differ:\n got %+v\nwant %+v", replayed, recorded)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "replay")); !os.IsNotExist(err) {
+		t.Errorf("replay touched the filesystem: %v", err)
+	}
+}
+
+func TestSkipVerifyTransport(t *testing.T) {
+	newServer := func() *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		// Rejected handshakes are expected; don't log them.
+		srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		srv.StartTLS()
+		return srv
+	}
+	selfSigned := newServer()
+	defer selfSigned.Close()
+	other := newServer()
+	defer other.Close()
+
+	tr := newSkipVerifyTransport()
+	get := func(srv *httptest.Server) error {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(selfSigned); err == nil {
+		t.Error("self-signed certificate accepted before skipping its host")
+	}
+	tr.skipHost(strings.TrimPrefix(selfSigned.URL, "https://"))
+	if err := get(selfSigned); err != nil {
+		t.Errorf("self-signed certificate rejected after skipping its host: %v", err)
+	}
+	if err := get(other); err == nil {
+		t.Error("self-signed certificate of another host accepted")
+	}
+}
@@ -1,15 +1,14 @@
 package test
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 )
 
 const (
-	helmVersion                 = "v2.9.1"
 	tillerContactTimeoutSeconds = 5
 	tillerContactTimeout        = tillerContactTimeoutSeconds * time.Second
 	// Helm itself doesn't usually need much time to deploy, but if the cluster just
@@ -19,19 +18,27 @@ const (
 
 type (
 	helmTool struct {
+		bin      string
 		profile  string
 		helmhome string
+		// kubeconfig is the KUBECONFIG helm runs with, empty for the
+		// default ~/.kube/config.
+		kubeconfig string
 	}
 
 	helmAPI interface {
 		tillerVersion() (string, error)
 		delete(releaseName string, purge bool) error
 		history(releaseName string) ([]helmHistory, error)
+		list() ([]string, error)
+		getValues(releaseName string, revision int) (string, error)
 		mustGetValues(releaseName string, revision int) string
 		mustUpgrade(releaseName string, chartpath string, reuseValues bool,
 			valueSettings ...string)
 		mustInstall(namespace string, releaseName string, chartpath string,
 			valueSettings ...string)
+		// withLogger returns a copy that logs to lg.
+		withLogger(lg logger) helmAPI
 	}
 
 	helm struct {
@@ -49,7 +56,7 @@ type (
 )
 
 func (ht helmTool) common() []string {
-	return []string{"helm", "--kube-context", ht.profile,
+	return []string{ht.bin, "--kube-context", ht.profile,
 		"--home", ht.helmhome}
 }
 
@@ -110,43 +117,56 @@ func (ht helmTool) historyCmd(releaseName string) []string {
 	return append(ht.commonPostInit(), []string{"history", "-ojson", releaseName}...)
 }
 
+func (ht helmTool) listCmd() []string {
+	return append(ht.commonPostInit(), []string{"list", "--all", "--short"}...)
+}
+
 func (ht helmTool) getValuesCmd(releaseName string, revision int) []string {
 	return append(ht.commonPostInit(), []string{"get", "values", releaseName,
 		"--revision", fmt.Sprintf("%d", revision)}...)
 }
 
-func newHelmTool(profile string, helmhome string) (*helmTool, error) {
-	return &helmTool{profile: profile, helmhome: helmhome}, nil
+func newHelmTool(bin string, profile string, kubeconfig string, helmhome string) (*helmTool, error) {
+	return &helmTool{bin: bin, profile: profile, kubeconfig: kubeconfig, helmhome: helmhome}, nil
 }
 
-func mustNewHelm(lg logger, profile string, helmhome string, k kubectlAPI) helm {
-	ht, err := newHelmTool(profile, helmhome)
+func mustNewHelm(lg logger, bin string, profile string, kubeconfig string, helmhome string, k kubectlAPI) helm {
+	ht, err := newHelmTool(bin, profile, kubeconfig, helmhome)
 	if err != nil {
 		lg.Fatalf("%v", err)
 	}
 
 	h := helm{ht: *ht, lg: lg}
-	out := h.cli().must(context.Background(), h.ht.versionCmd("client")...)
+	ctx, cancel := opContext("helm.version")
+	out := h.cli().must(ctx, h.ht.versionCmd("client")...)
+	cancel()
 	clientVersion, err := parseHelmVersionString(out)
-	if err != nil || clientVersion != helmVersion {
-		lg.Fatalf("helm client version is %v but we require %v", out, helmVersion)
+	if err != nil {
+		lg.Fatalf("%v", err)
 	}
+	helmCompat.mustCheck(lg, clientVersion)
 
+	// Tiller has to match the client, so (re)install it if it doesn't.
 	tillerVersion, err := h.tillerVersion()
-	if err != nil || tillerVersion != helmVersion {
+	if err != nil || tillerVersion != clientVersion {
 		h.mustInit(k)
 	}
 
 	tillerVersion, err = h.tillerVersion()
-	if err != nil || tillerVersion != helmVersion {
-		lg.Fatalf("running tiller version is %s but only %s is supported",
-			tillerVersion, helmVersion)
+	if err != nil || tillerVersion != clientVersion {
+		lg.Fatalf("running tiller version is %s but the helm client is %s",
+			tillerVersion, clientVersion)
 	}
 	return h
 }
 
-func (h helm) cli() clicmd {
-	return newCli(h.lg, nil)
+// cli returns a clicmd that logs with the given key-value fields.
+func (h helm) cli(kv ...interface{}) clicmd {
+	return newCli(h.logger(kv...), kubeconfigEnv(h.ht.kubeconfig))
+}
+
+func (h helm) logger(kv ...interface{}) logger {
+	return withFields(h.lg, append([]interface{}{"tool", "helm"}, kv...)...)
 }
 
 func parseHelmVersionString(s string) (string, error) {
@@ -158,8 +178,13 @@ func parseHelmVersionString(s string) (string, error) {
 	return version[1], nil
 }
 
+func (h helm) withLogger(lg logger) helmAPI {
+	h.lg = lg
+	return h
+}
+
 func (h helm) tillerVersion() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), tillerContactTimeout)
+	ctx, cancel := opContext("helm.version")
 	out, err := h.cli().run(ctx, h.ht.versionCmd("server")...)
 	cancel()
 	if err != nil {
@@ -177,18 +202,22 @@ func (h helm) mustInit(k kubectlAPI) {
 	if err != nil {
 		h.lg.Fatalf("Unable to create tiller clusterrolebinding: %v", err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), tillerInitTimeout)
-	h.cli().must(ctx, h.ht.initCmd()...)
+	ctx, cancel := opContext("helm.init")
+	newStreamingCli(h.logger(), kubeconfigEnv(h.ht.kubeconfig)).must(ctx, h.ht.initCmd()...)
 	cancel()
 }
 
 func (h helm) delete(releaseName string, purge bool) error {
-	_, err := h.cli().run(context.Background(), h.ht.deleteCmd(releaseName, purge)...)
+	ctx, cancel := opContext("helm.delete")
+	defer cancel()
+	_, err := h.cli("release", releaseName).run(ctx, h.ht.deleteCmd(releaseName, purge)...)
 	return err
 }
 
 func (h helm) history(releaseName string) ([]helmHistory, error) {
-	out, err := h.cli().run(context.Background(), h.ht.historyCmd(releaseName)...)
+	ctx, cancel := opContext("helm.history")
+	defer cancel()
+	out, err := h.cli("release", releaseName).run(ctx, h.ht.historyCmd(releaseName)...)
 	if err != nil {
 		return nil, err
 	}
@@ -201,16 +230,41 @@ func (h helm) history(releaseName string) ([]helmHistory, error) {
 	return hist, nil
 }
 
+// list returns the names of all releases, including deleted ones.
+func (h helm) list() ([]string, error) {
+	ctx, cancel := opContext("helm.list")
+	defer cancel()
+	out, err := h.cli().run(ctx, h.ht.listCmd()...)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+func (h helm) getValues(releaseName string, revision int) (string, error) {
+	ctx, cancel := opContext("helm.get-values")
+	defer cancel()
+	return h.cli("release", releaseName).run(ctx, h.ht.getValuesCmd(releaseName, revision)...)
+}
+
 func (h helm) mustGetValues(releaseName string, revision int) string {
-	return h.cli().must(context.Background(), h.ht.getValuesCmd(releaseName, revision)...)
+	out, err := h.getValues(releaseName, revision)
+	if err != nil {
+		h.lg.Fatalf("%v", err)
+	}
+	return out
 }
 
 func (h helm) mustUpgrade(releaseName string, chartpath string, reuseValues bool, valueSettings ...string) {
-	h.cli().must(context.Background(),
+	ctx, cancel := opContext("helm.upgrade")
+	defer cancel()
+	h.cli("release", releaseName).must(ctx,
 		h.ht.upgradeCmd(releaseName, chartpath, reuseValues, valueSettings...)...)
 }
 
 func (h helm) mustInstall(namespace string, releaseName string, chartpath string, valueSettings ...string) {
-	h.cli().must(context.Background(),
+	ctx, cancel := opContext("helm.install")
+	defer cancel()
+	h.cli("release", releaseName, "namespace", namespace).must(ctx,
 		h.ht.installCmd(namespace, releaseName, chartpath, valueSettings...)...)
 }
@@ -5,7 +5,6 @@ package test
 import (
 	"context"
 	"fmt"
-	"net"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -16,8 +15,8 @@ const (
 	defaultHelloworldPort = 30030
 	defaultSidecarPort    = 30031
 	releaseName1          = "test1"
+	helmReleaseNamespace  = "test1"
 	defaultPollInterval   = 5 * time.Second
-	yq                    = "bin/yq"
 )
 
 func (h *harness) installFluxChart(pollinterval time.Duration) {
@@ -25,32 +24,54 @@ func (h *harness) installFluxChart(pollinterval time.Duration) {
 	// Hack until #1009 is fixed.
 	h.helmAPI.delete(releaseName1, true)
 	h.helmAPI.mustInstall(fluxNamespace, helmFluxRelease, "helm/charts/weave-flux",
-		"helmOperator.create=true",
-		"git.url="+h.gitURL(),
+		append([]string{"helmOperator.create=true"}, h.fluxChartValues(h.harnessOptions, pollinterval)...)...)
+}
+
+// fluxChartValues are the chart values for a flux syncing from our repo as
+// opts say.
+func (h *harness) fluxChartValues(opts harnessOptions, pollinterval time.Duration) []string {
+	return []string{
+		"git.url=" + h.gitURL(),
+		"git.branch=" + opts.branch,
+		"git.path=" + opts.gitPath,
+		"git.user=" + fluxGitUser,
+		"git.email=" + fluxGitEmail,
+		"git.syncTag=" + opts.syncTag,
+		fmt.Sprintf("git.sslNoVerify=%v", opts.gitTransport == "https"),
 		"git.chartsPath=charts",
-		"git.pollInterval="+pollinterval.String())
+		"git.pollInterval=" + pollinterval.String(),
+	}
 }
 
 func (h *harness) installGitChart() {
 	h.helmAPI.delete(helmGitRelease, true)
-	h.helmAPI.mustInstall(fluxNamespace, helmGitRelease, "helm/charts/git-server")
+	var values []string
+	if h.gitTransport != "ssh" {
+		values = append(values,
+			"http.enabled=true",
+			fmt.Sprintf("http.tls=%v", h.gitTransport == "https"),
+			fmt.Sprintf("http.nodePort=%d", gitHTTPPort),
+			"http.username="+gitHTTPUser,
+			"http.password="+global.gitHTTPToken)
+	}
+	h.helmAPI.mustInstall(fluxNamespace, helmGitRelease, "helm/charts/git-server", values...)
 }
 
 func (h *harness) gitAddCommitPushSync() {
-	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	ctx, cancel := context.WithTimeout(h.ctx, syncTimeout)
 	h.mustAddCommitPush()
 	h.waitForSync(ctx, "HEAD")
 	cancel()
 }
 
 func (h *harness) pushNewHelmFluxRepo(ctx context.Context) {
-	execNoErr(ctx, h.t, "cp", "-rT", "helm/repo", h.repodir)
+	h.cli().must(ctx, "cp", "-rT", "helm/repo", h.repodir)
 	h.gitAddCommitPushSync()
 }
 
 func (h *harness) initHelmTest(pollinterval time.Duration) {
 	h.installFluxChart(pollinterval)
-	h.pushNewHelmFluxRepo(context.Background())
+	h.pushNewHelmFluxRepo(h.ctx)
 }
 
 func (h *harness) lastHelmRelease(releaseName string) (helmHistory, error) {
@@ -86,8 +107,13 @@ func (h *harness) helmReleaseHasValue(releaseName string, minRevision int, key,
 	}
 
 	valstr := h.helmAPI.mustGetValues(releaseName, hist.Revision)
-	yqout := strings.TrimSpace(strOrDie(
-		envExecStdin(context.Background(), h.t, nil, strings.NewReader(valstr), yq, "r", "-", key)))
+	ctx, cancel := opContext("yq")
+	defer cancel()
+	out, err := h.cli().input(ctx, valstr, global.tools.path("yq"), "r", "-", key)
+	if err != nil {
+		return err
+	}
+	yqout := strings.TrimSpace(out)
 	if val != yqout {
 		return fmt.Errorf("expected value for %q is %q, got %q", key, val, yqout)
 	}
@@ -97,7 +123,7 @@ func (h *harness) helmReleaseHasValue(releaseName string, minRevision int, key,
 func (h *harness) assertHelmReleaseDeployed(releaseName string, minRevision int) int {
 	h.t.Helper()
 	var hist helmHistory
-	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	ctx, cancel := context.WithTimeout(h.ctx, releaseTimeout)
 	defer cancel()
 	h.must(until(ctx, func(ictx context.Context) error {
 		var err error
@@ -111,41 +137,52 @@ func (h *harness) assertHelmReleaseDeployed(releaseName string, minRevision int)
 }
 
 func (h *harness) assertHelmReleaseHasValue(timeout time.Duration, releaseName string, minRevision int, key, val string) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(h.ctx, timeout)
 	defer cancel()
 	h.must(until(ctx, func(ictx context.Context) error {
 		return h.helmReleaseHasValue(releaseName, minRevision, key, val)
 	}))
 }
 
+// dialWithin tries once to connect to addr, giving up after timeout.
+func (h *harness) dialWithin(addr string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(h.ctx, timeout)
+	defer cancel()
+	return h.probes.dial(ctx, addr)
+}
+
 func (h *harness) updateGitYaml(relpath string, yamlpath string, value string) {
-	execNoErr(context.Background(), h.t, yq, "w", "-i",
+	ctx, cancel := opContext("yq")
+	defer cancel()
+	h.cli().must(ctx, global.tools.path("yq"), "w", "-i",
 		filepath.Join(h.repodir, relpath), yamlpath, value)
 }
 
 func TestChart(t *testing.T) {
 	h := newharness(t)
+	defer h.done()
 	h.initHelmTest(defaultPollInterval)
 
 	h.assertHelmReleaseDeployed(releaseName1, 1)
-	h.must(portOpen(context.Background(), h.clusterIP, defaultHelloworldPort))
-	h.must(httpGetReturns(h.clusterIP, defaultHelloworldPort, "Ahoy\n"))
-	h.must(httpGetReturns(h.clusterIP, defaultSidecarPort, "I am a sidecar\n"))
+	h.must(portOpen(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort, "Ahoy\n"))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultSidecarPort, "I am a sidecar\n"))
 }
 
 func TestChartUpdateViaGit(t *testing.T) {
 	h := newharness(t)
+	defer h.done()
 	h.initHelmTest(defaultPollInterval)
 
 	initialRevision := h.assertHelmReleaseDeployed(releaseName1, 1)
-	h.must(portOpen(context.Background(), h.clusterIP, defaultHelloworldPort))
-	h.must(httpGetReturns(h.clusterIP, defaultHelloworldPort, "Ahoy\n"))
-	h.must(httpGetReturns(h.clusterIP, defaultSidecarPort, "I am a sidecar\n"))
+	h.must(portOpen(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort, "Ahoy\n"))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultSidecarPort, "I am a sidecar\n"))
 
 	// obviously this should work if the above works, it's just to
 	// contrast with the Dial invocation below
-	_, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", h.clusterIP, defaultSidecarPort), 5*time.Second)
-	h.must(err)
+	oldSidecarAddr := fmt.Sprintf("%s:%d", h.clusterIP, defaultSidecarPort)
+	h.must(h.dialWithin(oldSidecarAddr, 5*time.Second))
 
 	newMessage := "salut"
 	newSidecarPort := defaultSidecarPort + 2
@@ -155,24 +192,24 @@ func TestChartUpdateViaGit(t *testing.T) {
 	h.gitAddCommitPushSync()
 
 	h.assertHelmReleaseDeployed(releaseName1, initialRevision+1)
-	h.must(httpGetReturns(h.clusterIP, defaultHelloworldPort, newMessage+"\n"))
-	h.must(httpGetReturns(h.clusterIP, newSidecarPort, "I am a sidecar\n"))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort, newMessage+"\n"))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, newSidecarPort, "I am a sidecar\n"))
 
-	_, err = net.DialTimeout("tcp", fmt.Sprintf("%s:%d", h.clusterIP, defaultSidecarPort), 5*time.Second)
-	if err == nil {
+	if err := h.dialWithin(oldSidecarAddr, 5*time.Second); err == nil {
 		t.Errorf("old sidecar port %d still open", defaultSidecarPort)
 	}
 }
 
 func TestChartUpdateViaHelm(t *testing.T) {
 	h := newharness(t)
+	defer h.done()
 	pollInterval := 20 * time.Second
 	h.initHelmTest(pollInterval)
 
 	initialRevision := h.assertHelmReleaseDeployed(releaseName1, 1)
-	h.must(portOpen(context.Background(), h.clusterIP, defaultHelloworldPort))
-	h.must(httpGetReturns(h.clusterIP, defaultHelloworldPort, "Ahoy\n"))
-	h.must(httpGetReturns(h.clusterIP, defaultSidecarPort, "I am a sidecar\n"))
+	h.must(portOpen(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort, "Ahoy\n"))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultSidecarPort, "I am a sidecar\n"))
 
 	key, val := "hellomessage", "greetings"
 	h.helmAPI.mustUpgrade(releaseName1,
@@ -180,11 +217,11 @@ func TestChartUpdateViaHelm(t *testing.T) {
 		true, fmt.Sprintf("%s=%s", key, val))
 
 	h.assertHelmReleaseHasValue(releaseTimeout, releaseName1, initialRevision+1, key, val)
-	h.must(httpGetReturns(h.clusterIP, defaultHelloworldPort, val+"\n"))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort, val+"\n"))
 
 	// TODO specify minrevision more precisely
 	h.assertHelmReleaseHasValue(releaseTimeout+pollInterval, releaseName1, initialRevision+1, key, "null")
-	h.must(httpGetReturns(h.clusterIP, defaultHelloworldPort, "Ahoy\n"))
+	h.must(httpGetReturns(h.ctx, h.probes, h.clusterIP, defaultHelloworldPort, "Ahoy\n"))
 }
 
 // TODO tests:
@@ -0,0 +1,150 @@
+// +build integration_test
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	rewriteConfigMap         = "rewrite-test"
+	rewriteConfigMapManifest = "rewrite-test-configmap.yaml"
+	// gcGracePeriod is how long we give flux to delete something after
+	// syncing a revision without it, when we expect it not to.
+	gcGracePeriod = 3 * defaultPollInterval
+)
+
+// writeRewriteConfigMap adds a configmap manifest to the repo, giving us a
+// resource whose removal from git we can watch for.
+func (h *harness) writeRewriteConfigMap() {
+	h.t.Helper()
+	manifest := fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  namespace: %s
+data:
+  test: %s
+`, rewriteConfigMap, appNamespace, h.t.Name())
+	h.must(ioutil.WriteFile(filepath.Join(h.manifestDir(), rewriteConfigMapManifest), []byte(manifest), 0644))
+}
+
+// resourceExists reports whether the named resource exists in the cluster.
+func (h *harness) resourceExists(namespace, kind, name string) (bool, error) {
+	k := global.kubectlAPI.withLogger(h.lg)
+	_, err := k.get(namespace, kind, name, "-o", "name")
+	if err == nil {
+		return true, nil
+	}
+	if strings.Contains(err.Error(), "NotFound") {
+		return false, nil
+	}
+	return false, err
+}
+
+// waitForResource waits until the named resource exists, or doesn't.
+func (h *harness) waitForResource(ctx context.Context, namespace, kind, name string, exists bool) {
+	h.t.Helper()
+	h.must(until(ctx, func(ictx context.Context) error {
+		found, err := h.resourceExists(namespace, kind, name)
+		if err != nil {
+			return err
+		}
+		if found != exists {
+			return fmt.Errorf("%s %s/%s exists=%v, want %v", kind, namespace, name, found, exists)
+		}
+		return nil
+	}))
+}
+
+// rewriteTo resets our branch to rev and force-pushes it, returning the
+// commit now at the head of the branch.
+func (h *harness) rewriteTo(rev string) string {
+	h.t.Helper()
+	h.must(h.reset(rev))
+	h.must(h.forcePush(h.branch))
+	head, err := h.resolve("HEAD")
+	h.must(err)
+	h.lg.Logf("rewrote %s to %s", h.branch, head)
+	return head
+}
+
+// TestForcePushReset resets the branch to before a resource was added and
+// force-pushes, then checks flux resyncs to the rewritten history.  Flux
+// doesn't garbage-collect, so the resource should outlive the rewrite.
+func TestForcePushReset(t *testing.T) {
+	h := newharness(t)
+	defer h.done()
+	h.applyFlux()
+	h.deployViaGit(context.TODO())
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+	before, err := h.resolve("HEAD")
+	h.must(err)
+
+	ctx, cancel := context.WithTimeout(h.ctx, syncTimeout)
+	defer cancel()
+	h.writeRewriteConfigMap()
+	h.mustAddCommitPush()
+	h.waitForSync(ctx, "HEAD")
+	h.waitForResource(ctx, appNamespace, "configmap", rewriteConfigMap, true)
+
+	h.rewriteTo(before)
+	h.waitForSync(ctx, "HEAD")
+	time.Sleep(gcGracePeriod)
+	if found, err := h.resourceExists(appNamespace, "configmap", rewriteConfigMap); err != nil || !found {
+		t.Errorf("configmap %s removed from git by rewrite: exists=%v, err=%v, want it left alone",
+			rewriteConfigMap, found, err)
+	}
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+}
+
+// TestForcePushAmend amends the synced commit to change the images and
+// force-pushes it, checking flux applies the amended commit.
+func TestForcePushAmend(t *testing.T) {
+	h := newharness(t)
+	defer h.done()
+	h.applyFlux()
+	h.deployViaGit(context.TODO())
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+
+	_, err := writeHelloWorldDeployment(h.manifestDir(), automatedHelloworldImageTag, automatedSidecarImageTag)
+	h.must(err)
+	_, err = h.amend("deploy, amended")
+	h.must(err)
+	if err := h.push(h.branch); err == nil {
+		t.Fatalf("Pushing an amended commit succeeded without force")
+	}
+	h.must(h.forcePush(h.branch))
+	h.verifySyncAndSvcs(t, "HEAD", automatedHelloworldImageTag, automatedSidecarImageTag)
+}
+
+// TestSyncTagRewrite deletes the sync tag and then moves it back in
+// history, checking each time that flux puts it back on the head of the
+// branch.
+func TestSyncTagRewrite(t *testing.T) {
+	h := newharness(t)
+	defer h.done()
+	h.applyFlux()
+	h.deployViaGit(context.TODO())
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+	h.pushUnrelatedChange()
+
+	ctx, cancel := context.WithTimeout(h.ctx, syncTimeout)
+	defer cancel()
+	h.waitForSync(ctx, "HEAD")
+
+	h.must(h.deleteTag(h.syncTag))
+	h.lg.Logf("deleted %s", h.syncTag)
+	h.waitForSync(ctx, "HEAD")
+
+	h.must(h.pushTag(h.syncTag, "HEAD~1"))
+	h.lg.Logf("moved %s back to HEAD~1", h.syncTag)
+	h.waitForSync(ctx, "HEAD")
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+}
@@ -0,0 +1,195 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	// imageSpec is an image that some scenario runs in the cluster.
+	imageSpec struct {
+		ref string
+		// usedBy says what runs it, for error messages.
+		usedBy string
+	}
+
+	// imageCache keeps images as docker save tarballs in dir, so that once
+	// it's filled the images can be had without a registry.  An index
+	// records the ID of each image, which is checked when it's loaded.
+	imageCache struct {
+		// dir is empty if there's no cache.
+		dir string
+		d   docker
+		lg  logger
+	}
+
+	cachedImage struct {
+		File string `json:"file"`
+		ID   string `json:"id"`
+	}
+)
+
+const (
+	imageCacheIndex = "index.json"
+	// gitHTTPImage is the git-server chart's http sidecar.  It isn't
+	// published; download-prereqs.sh builds it.
+	gitHTTPImage = "fluxtest/git-http:alpine-3.8"
+)
+
+// requiredImages is every image the charts and scenarios run, besides
+// tiller, whose tag depends on the helm client; see imagesFor.  Keep it in
+// step with the chart defaults and the image tags in flux_test.go.
+var requiredImages = []imageSpec{
+	{"quay.io/weaveworks/flux:1.5.0", "weave-flux chart"},
+	{"quay.io/weaveworks/helm-operator:master-4d13559", "weave-flux chart"},
+	{"memcached:1.4.25", "weave-flux chart"},
+	{dnsCheckImage, "cluster dns readiness check"},
+	{"jkarlos/git-server-docker:latest", "git-server chart"},
+	{gitHTTPImage, "git-server chart http sidecar, built by download-prereqs.sh"},
+	{"quay.io/weaveworks/helloworld:master-a000001", "helloworld deployment and chart"},
+	{"quay.io/weaveworks/helloworld:master-07a1b6b", "automation scenarios"},
+	{"quay.io/weaveworks/sidecar:master-a000001", "helloworld deployment and chart"},
+	{"quay.io/weaveworks/sidecar:master-a000002", "automation scenarios"},
+}
+
+// imagesFor returns requiredImages plus the tiller image helm init installs
+// for the given helm client version.
+func imagesFor(helmClientVersion string) []imageSpec {
+	return append(append([]imageSpec(nil), requiredImages...),
+		imageSpec{"gcr.io/kubernetes-helm/tiller:" + helmClientVersion, "helm init"})
+}
+
+func newImageCache(lg logger, dir string, d docker) (*imageCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create image cache: %v", err)
+		}
+	}
+	return &imageCache{dir: dir, d: d, lg: lg}, nil
+}
+
+// imageFileName returns the name of the cache tarball for ref.
+func imageFileName(ref string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(ref) + ".tar"
+}
+
+func (c *imageCache) index() (map[string]cachedImage, error) {
+	idx := make(map[string]cachedImage)
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, imageCacheIndex))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read image cache index: %v", err)
+	}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("unable to parse image cache index: %v", err)
+	}
+	return idx, nil
+}
+
+func (c *imageCache) writeIndex(idx map[string]cachedImage) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(c.dir, imageCacheIndex), data, 0644); err != nil {
+		return fmt.Errorf("unable to write image cache index: %v", err)
+	}
+	return nil
+}
+
+// loadCached loads ref from the cache into the docker daemon, returning
+// false if it isn't cached.  It's an error if the loaded image's ID isn't
+// the one recorded when it was cached.
+func (c *imageCache) loadCached(ref string) (bool, error) {
+	if c.dir == "" {
+		return false, nil
+	}
+	idx, err := c.index()
+	if err != nil {
+		return false, err
+	}
+	entry, ok := idx[ref]
+	if !ok {
+		return false, nil
+	}
+	if err := c.d.load(filepath.Join(c.dir, entry.File)); err != nil {
+		return false, err
+	}
+	id, err := c.d.imageID(ref)
+	if err != nil {
+		return false, err
+	}
+	if id != entry.ID {
+		return false, fmt.Errorf("cached tarball %s holds image %s, but %s was recorded", entry.File, id, entry.ID)
+	}
+	debugf(c.lg, "loaded %s from the image cache", ref)
+	return true, nil
+}
+
+// store saves ref to the cache, unless it's already there with the same ID.
+func (c *imageCache) store(ref string, id string) error {
+	if c.dir == "" {
+		return nil
+	}
+	idx, err := c.index()
+	if err != nil {
+		return err
+	}
+	entry := cachedImage{File: imageFileName(ref), ID: id}
+	if idx[ref] == entry {
+		if _, err := os.Stat(filepath.Join(c.dir, entry.File)); err == nil {
+			return nil
+		}
+	}
+	if err := c.d.save(ref, filepath.Join(c.dir, entry.File)); err != nil {
+		return err
+	}
+	idx[ref] = entry
+	return c.writeIndex(idx)
+}
+
+// ensure makes sure the docker daemon has ref, loading it from the cache or,
+// if pull is set, pulling it.  Images the daemon has are added to the cache.
+func (c *imageCache) ensure(ref string, pull bool) error {
+	id, err := c.d.imageID(ref)
+	if err != nil {
+		loaded, err := c.loadCached(ref)
+		if err != nil {
+			return err
+		}
+		if !loaded {
+			if !pull {
+				return fmt.Errorf("not in docker or the image cache, and pulling is disabled")
+			}
+			if err := c.d.pull(ref); err != nil {
+				return err
+			}
+		}
+		if id, err = c.d.imageID(ref); err != nil {
+			return err
+		}
+	}
+	return c.store(ref, id)
+}
+
+// ensureAll calls ensure for each image, returning an error listing every
+// image that couldn't be had.
+func (c *imageCache) ensureAll(images []imageSpec, pull bool) error {
+	var missing []string
+	for _, img := range images {
+		if err := c.ensure(img.ref, pull); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (for %s): %v", img.ref, img.usedBy, err))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d of %d images are unavailable:\n%s",
+			len(missing), len(images), strings.Join(missing, "\n"))
+	}
+	return nil
+}
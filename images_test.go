@@ -0,0 +1,90 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImageCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dt := dockerTool{bin: "docker"}
+	c, err := newImageCache(t, dir, docker{dt: dt, lg: t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ref = "quay.io/weaveworks/flux:1.5.0"
+	tarball := filepath.Join(dir, imageFileName(ref))
+
+	// An image docker has is added to the cache.
+	f := newFakeCli(t)
+	f.expect(dt.imageIDCmd(ref)...).returns("sha256:aaa\n")
+	f.expect(dt.saveCmd(ref, tarball)...)
+	restore := f.install()
+	if err := c.ensure(ref, false); err != nil {
+		t.Fatal(err)
+	}
+	restore()
+	if err := ioutil.WriteFile(tarball, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// One docker doesn't have is loaded from the cache, and not saved again.
+	f = newFakeCli(t)
+	f.expect(dt.imageIDCmd(ref)...).fails("Error: No such image")
+	f.expect(dt.loadCmd(tarball)...)
+	f.expect(dt.imageIDCmd(ref)...).returns("sha256:aaa\n")
+	f.expect(dt.imageIDCmd(ref)...).returns("sha256:aaa\n")
+	restore = f.install()
+	if err := c.ensure(ref, false); err != nil {
+		t.Fatal(err)
+	}
+	restore()
+
+	// A tarball that doesn't hold the recorded image is an error.
+	f = newFakeCli(t)
+	f.expect(dt.imageIDCmd(ref)...).fails("Error: No such image")
+	f.expect(dt.loadCmd(tarball)...)
+	f.expect(dt.imageIDCmd(ref)...).returns("sha256:bbb\n")
+	restore = f.install()
+	if err := c.ensure(ref, false); err == nil || !strings.Contains(err.Error(), "sha256:aaa was recorded") {
+		t.Errorf("ensure() = %v, want an ID mismatch", err)
+	}
+	restore()
+
+	// Uncached images are pulled if allowed, and reported if not.
+	const other = "memcached:1.4.25"
+	f = newFakeCli(t)
+	f.expect(dt.imageIDCmd(other)...).fails("Error: No such image")
+	f.expect(dt.imageIDCmd(other)...).fails("Error: No such image")
+	f.expect(dt.pullCmd(other)...)
+	f.expect(dt.imageIDCmd(other)...).returns("sha256:ccc\n")
+	f.expect(dt.saveCmd(other, filepath.Join(dir, imageFileName(other)))...)
+	defer f.install()()
+	err = c.ensureAll([]imageSpec{{other, "weave-flux chart"}}, false)
+	if err == nil || !strings.Contains(err.Error(), other+" (for weave-flux chart)") {
+		t.Errorf("ensureAll() = %v, want an error naming %s", err, other)
+	}
+	if err := c.ensure(other, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImagesFor(t *testing.T) {
+	images := imagesFor("v2.10.0")
+	if len(images) != len(requiredImages)+1 {
+		t.Fatalf("imagesFor returned %d images, want %d", len(images), len(requiredImages)+1)
+	}
+	if got, want := images[len(images)-1].ref, "gcr.io/kubernetes-helm/tiller:v2.10.0"; got != want {
+		t.Errorf("tiller image is %s, want %s", got, want)
+	}
+	if other := imagesFor("v2.9.1"); other[len(other)-1].ref == images[len(images)-1].ref {
+		t.Errorf("imagesFor shares its result between helm versions")
+	}
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"os"
+	"strings"
+)
+
+type (
+	// kubeconfigCluster is a clusterAPI for a cluster someone else looks
+	// after, reached through an existing kubeconfig context.  It can't
+	// start, delete or load images into the cluster.
+	kubeconfigCluster struct {
+		kt kubectlTool
+		lg logger
+	}
+)
+
+func (kt kubectlTool) currentContextCmd() []string {
+	return []string{kt.bin, "config", "current-context"}
+}
+
+func (kt kubectlTool) nodeIPCmd() []string {
+	return append(kt.common(), "get", "nodes", "-o",
+		`jsonpath={.items[0].status.addresses[?(@.type=="InternalIP")].address}`)
+}
+
+// mustNewKubeconfigCluster returns a provider for the given kubeconfig
+// context, or the current context if it's empty.  The kubeconfig is the
+// one given by our own KUBECONFIG, if set, which the tools are passed
+// explicitly since they don't otherwise inherit it.
+func mustNewKubeconfigCluster(lg logger, bin string, context string) kubeconfigCluster {
+	kt := kubectlTool{bin: bin, profile: context, kubeconfig: os.Getenv("KUBECONFIG")}
+	c := kubeconfigCluster{kt: kt, lg: lg}
+	if context == "" {
+		ctx, cancel := opContext("kubectl.config")
+		out, err := c.cli().run(ctx, kt.currentContextCmd()...)
+		cancel()
+		c.kt.profile = strings.TrimSpace(out)
+		if err != nil || c.kt.profile == "" {
+			lg.Fatalf("Unable to determine the current kubeconfig context, use -kube-context: %v", err)
+		}
+	}
+	return c
+}
+
+func (c kubeconfigCluster) cli() clicmd {
+	return newCli(withFields(c.lg, "tool", "kubectl"), c.kt.env())
+}
+
+func (c kubeconfigCluster) name() string {
+	return "kubeconfig"
+}
+
+func (c kubeconfigCluster) version() string {
+	return "context " + c.kt.profile + ", kubernetes " + kubectl{kt: c.kt, lg: c.lg}.kubeVersion()
+}
+
+func (c kubeconfigCluster) start() {
+	c.lg.Fatalf("The kubeconfig cluster provider can't start clusters; drop -start-minikube")
+}
+
+func (c kubeconfigCluster) delete() {
+	c.lg.Fatalf("The kubeconfig cluster provider can't delete clusters")
+}
+
+func (c kubeconfigCluster) nodeIP() string {
+	ctx, cancel := opContext("kubectl.get")
+	defer cancel()
+	ip := strings.TrimSpace(c.cli().must(ctx, c.kt.nodeIPCmd()...))
+	if ip == "" {
+		c.lg.Fatalf("Unable to find an InternalIP address for the nodes of context %s", c.kt.profile)
+	}
+	return ip
+}
+
+// loadDockerImage can't reach into an arbitrary cluster, so the image has to
+// be pullable from wherever the cluster's nodes pull images.
+func (c kubeconfigCluster) loadDockerImage(imageName string) {
+	warnf(c.lg, "Not loading %s: the kubeconfig cluster provider relies on the cluster being able to pull it", imageName)
+}
+
+func (c kubeconfigCluster) kubeContext() string {
+	return c.kt.profile
+}
+
+func (c kubeconfigCluster) kubeconfig() string {
+	return c.kt.kubeconfig
+}
+
+func (c kubeconfigCluster) withLogger(lg logger) clusterAPI {
+	c.lg = lg
+	return c
+}
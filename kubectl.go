@@ -1,20 +1,26 @@
 package test
 
 import (
-	"context"
 	"regexp"
-	"time"
 )
 
 type (
 	kubectlTool struct {
+		bin     string
 		profile string
+		// kubeconfig is the KUBECONFIG kubectl runs with, empty for the
+		// default ~/.kube/config.
+		kubeconfig string
 	}
 
 	kubectlAPI interface {
 		kubeVersion() string
 		create(namespace string, args ...string) error
 		delete(namespace string, args ...string) error
+		get(namespace string, args ...string) (string, error)
+		logs(namespace string, pod string, container string, previous bool) (string, error)
+		// withLogger returns a copy that logs to lg.
+		withLogger(lg logger) kubectlAPI
 	}
 
 	kubectl struct {
@@ -24,7 +30,21 @@ type (
 )
 
 func (kt kubectlTool) common() []string {
-	return []string{"kubectl", "--context", kt.profile}
+	return []string{kt.bin, "--context", kt.profile}
+}
+
+// env returns the environment overlay kubectl runs with.
+func (kt kubectlTool) env() []string {
+	return kubeconfigEnv(kt.kubeconfig)
+}
+
+// kubeconfigEnv returns an environment overlay setting KUBECONFIG, which
+// childEnv otherwise stops tools inheriting, or nil if kubeconfig is empty.
+func kubeconfigEnv(kubeconfig string) []string {
+	if kubeconfig == "" {
+		return nil
+	}
+	return []string{"KUBECONFIG=" + kubeconfig}
 }
 
 func (kt kubectlTool) versionCmd() []string {
@@ -39,32 +59,52 @@ func (kt kubectlTool) deleteCmd(namespace string) []string {
 	return append(kt.common(), []string{"--namespace", namespace, "delete"}...)
 }
 
-func newKubectlTool(profile string) (*kubectlTool, error) {
-	return &kubectlTool{profile: profile}, nil
+func (kt kubectlTool) getCmd(namespace string) []string {
+	return append(kt.common(), []string{"--namespace", namespace, "get"}...)
+}
+
+// runCmd runs command in a pod of image, attached, deleting the pod when
+// it's done.
+func (kt kubectlTool) runCmd(namespace string, name string, image string, command ...string) []string {
+	return append(append(kt.common(), "--namespace", namespace, "run", name, "--image="+image,
+		"--restart=Never", "--rm", "--attach", "--quiet", "--command", "--"), command...)
+}
+
+func (kt kubectlTool) logsCmd(namespace string, pod string, container string, previous bool) []string {
+	args := append(kt.common(), []string{"--namespace", namespace, "logs", pod, "-c", container}...)
+	if previous {
+		args = append(args, "--previous")
+	}
+	return args
+}
+
+func newKubectlTool(bin string, profile string, kubeconfig string) (*kubectlTool, error) {
+	return &kubectlTool{bin: bin, profile: profile, kubeconfig: kubeconfig}, nil
 }
 
-func mustNewKubectl(lg logger, profile string) kubectl {
-	kt, err := newKubectlTool(profile)
+func mustNewKubectl(lg logger, bin string, profile string, kubeconfig string) kubectl {
+	kt, err := newKubectlTool(bin, profile, kubeconfig)
 	if err != nil {
 		lg.Fatalf("%v", err)
 	}
 
 	k := kubectl{kt: *kt, lg: lg}
-	runningVersion := k.kubeVersion()
-	if runningVersion != k8sVersion {
-		lg.Fatalf("running kubernetes version is %s but only %s is supported"+
-			", see https://github.com/kubernetes/kubernetes/issues/61076",
-			runningVersion, k8sVersion)
-	}
+	kubernetesCompat.mustCheck(lg, k.kubeVersion())
 	return k
 }
 
-func (k kubectl) cli() clicmd {
-	return newCli(k.lg, nil)
+// cli returns a clicmd that logs with the given key-value fields.
+func (k kubectl) cli(kv ...interface{}) clicmd {
+	return newCli(withFields(k.lg, append([]interface{}{"tool", "kubectl"}, kv...)...), k.kt.env())
+}
+
+func (k kubectl) withLogger(lg logger) kubectlAPI {
+	k.lg = lg
+	return k
 }
 
 func (k kubectl) kubeVersion() string {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := opContext("kubectl.version")
 	out := k.cli().must(ctx, k.kt.versionCmd()...)
 	cancel()
 
@@ -77,13 +117,34 @@ func (k kubectl) kubeVersion() string {
 }
 
 func (k kubectl) create(namespace string, args ...string) error {
-	_, err := k.cli().run(context.Background(),
-		append(k.kt.createCmd(namespace), args...)...)
+	ctx, cancel := opContext("kubectl.create")
+	defer cancel()
+	_, err := k.cli("namespace", namespace).run(ctx, append(k.kt.createCmd(namespace), args...)...)
 	return err
 }
 
 func (k kubectl) delete(namespace string, args ...string) error {
-	_, err := k.cli().run(context.Background(),
-		append(k.kt.deleteCmd(namespace), args...)...)
+	ctx, cancel := opContext("kubectl.delete")
+	defer cancel()
+	_, err := k.cli("namespace", namespace).run(ctx, append(k.kt.deleteCmd(namespace), args...)...)
 	return err
 }
+
+func (k kubectl) get(namespace string, args ...string) (string, error) {
+	ctx, cancel := opContext("kubectl.get")
+	defer cancel()
+	return k.cli("namespace", namespace).run(ctx, append(k.kt.getCmd(namespace), args...)...)
+}
+
+// run runs command in a short-lived pod, returning its output.
+func (k kubectl) run(namespace string, name string, image string, command ...string) (string, error) {
+	ctx, cancel := opContext("kubectl.run")
+	defer cancel()
+	return k.cli("namespace", namespace).run(ctx, k.kt.runCmd(namespace, name, image, command...)...)
+}
+
+func (k kubectl) logs(namespace string, pod string, container string, previous bool) (string, error) {
+	ctx, cancel := opContext("kubectl.logs")
+	defer cancel()
+	return k.cli("namespace", namespace).run(ctx, k.kt.logsCmd(namespace, pod, container, previous)...)
+}
@@ -0,0 +1,204 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+type (
+	level int
+
+	// leveledLogger is a logger with levels and key-value fields.  Logf
+	// logs at info level, Errorf and Fatalf at error level.
+	leveledLogger interface {
+		logger
+		Debugf(string, ...interface{})
+		Warnf(string, ...interface{})
+		// With returns a logger that adds the given key-value pairs to
+		// every line.
+		With(kv ...interface{}) leveledLogger
+	}
+
+	// structLogger implements leveledLogger on top of an output function
+	// and the failure semantics of whatever it's standing in for.
+	structLogger struct {
+		name   string
+		fields []interface{}
+		print  func(string)
+		helper func()
+		// fail marks the test (or setup) as failed without stopping it.
+		fail func()
+		// failNow marks it failed and unwinds; it must not return.
+		failNow func(msg string)
+	}
+
+	// fatalError is the panic value used to unwind from a setup logger's
+	// Fatalf; see recoverFatal.
+	fatalError struct {
+		msg string
+	}
+)
+
+// minLogLevel is the lowest level that gets logged.
+var minLogLevel = levelInfo
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (lv level) String() string {
+	if lv < 0 || int(lv) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int(lv))
+	}
+	return levelNames[lv]
+}
+
+// Set implements flag.Value.
+func (lv *level) Set(s string) error {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			*lv = level(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q, want one of %v", s, levelNames)
+}
+
+// newSetupLogger returns a logger for use outside of tests.  Its Fatalf
+// panics with a fatalError rather than exiting, so that deferred cleanup
+// runs; callers must use recoverFatal.
+func newSetupLogger() *structLogger {
+	return &structLogger{
+		print:   func(s string) { log.Print(s) },
+		helper:  func() {},
+		fail:    func() {},
+		failNow: func(msg string) { panic(fatalError{msg: msg}) },
+	}
+}
+
+// testingT is the subset of *testing.T used by newTestLogger.
+type testingT interface {
+	Name() string
+	Log(...interface{})
+	Helper()
+	Fail()
+	FailNow()
+}
+
+// newTestLogger returns a logger that writes to t and fails it on error.
+func newTestLogger(t testingT) *structLogger {
+	return &structLogger{
+		name:    t.Name(),
+		fields:  []interface{}{"test", t.Name()},
+		print:   func(s string) { t.Helper(); t.Log(s) },
+		helper:  t.Helper,
+		fail:    t.Fail,
+		failNow: func(string) { t.FailNow() },
+	}
+}
+
+func (l *structLogger) Name() string {
+	return l.name
+}
+
+func (l *structLogger) Helper() {
+	l.helper()
+}
+
+func (l *structLogger) With(kv ...interface{}) leveledLogger {
+	nl := *l
+	nl.fields = append(append([]interface{}(nil), l.fields...), kv...)
+	return &nl
+}
+
+func (l *structLogger) logf(lv level, s string, args ...interface{}) {
+	l.helper()
+	if lv < minLogLevel {
+		return
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%-5s ", lv)
+	fmt.Fprintf(&b, s, args...)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		fmt.Fprintf(&b, " %v=%q", l.fields[i], fmt.Sprint(l.fields[i+1]))
+	}
+	l.print(b.String())
+}
+
+func (l *structLogger) Debugf(s string, args ...interface{}) {
+	l.helper()
+	l.logf(levelDebug, s, args...)
+}
+
+func (l *structLogger) Logf(s string, args ...interface{}) {
+	l.helper()
+	l.logf(levelInfo, s, args...)
+}
+
+func (l *structLogger) Warnf(s string, args ...interface{}) {
+	l.helper()
+	l.logf(levelWarn, s, args...)
+}
+
+func (l *structLogger) Errorf(s string, args ...interface{}) {
+	l.helper()
+	l.logf(levelError, s, args...)
+	l.fail()
+}
+
+func (l *structLogger) Fatalf(s string, args ...interface{}) {
+	l.helper()
+	msg := fmt.Sprintf(s, args...)
+	l.logf(levelError, "%s", msg)
+	l.fail()
+	l.failNow(msg)
+}
+
+func (fe fatalError) Error() string {
+	return fe.msg
+}
+
+// recoverFatal is meant to be deferred by code using a setup logger.  It
+// stops the unwinding caused by Fatalf and sets *code to 1; other panics
+// are propagated.
+func recoverFatal(code *int) {
+	if r := recover(); r != nil {
+		if _, ok := r.(fatalError); !ok {
+			panic(r)
+		}
+		*code = 1
+	}
+}
+
+// debugf logs at debug level if lg supports levels, otherwise not at all.
+func debugf(lg logger, s string, args ...interface{}) {
+	lg.Helper()
+	if ll, ok := lg.(leveledLogger); ok {
+		ll.Debugf(s, args...)
+	}
+}
+
+// warnf logs at warn level if lg supports levels, otherwise via Logf.
+func warnf(lg logger, s string, args ...interface{}) {
+	lg.Helper()
+	if ll, ok := lg.(leveledLogger); ok {
+		ll.Warnf(s, args...)
+	} else {
+		lg.Logf(s, args...)
+	}
+}
+
+// withFields adds key-value fields to lg if it supports them.
+func withFields(lg logger, kv ...interface{}) logger {
+	if ll, ok := lg.(leveledLogger); ok {
+		return ll.With(kv...)
+	}
+	return lg
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStructLogger(t *testing.T) {
+	var lines []string
+	failed := false
+	lg := &structLogger{
+		print:   func(s string) { lines = append(lines, s) },
+		helper:  func() {},
+		fail:    func() { failed = true },
+		failNow: func(msg string) { panic(fatalError{msg: msg}) },
+	}
+
+	withTool := lg.With("tool", "helm").With("release", "cd")
+	withTool.Debugf("hidden")
+	withTool.Logf("installing %d", 1)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %q", lines)
+	}
+	if want := `info  installing 1 tool="helm" release="cd"`; lines[0] != want {
+		t.Errorf("got %q, want %q", lines[0], want)
+	}
+	if failed {
+		t.Errorf("Logf marked logger as failed")
+	}
+
+	code := func() (code int) {
+		defer recoverFatal(&code)
+		lg.Fatalf("boom")
+		return 0
+	}()
+	if code != 1 || !failed {
+		t.Errorf("Fatalf: got code %d, failed=%v", code, failed)
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], "error boom") {
+		t.Errorf("Fatalf logged %q", lines[len(lines)-1])
+	}
+}
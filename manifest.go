@@ -0,0 +1,68 @@
+package test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	containerNameRE = regexp.MustCompile(`^\s*-\s+name:\s*(\S+)\s*$`)
+	imageLineRE     = regexp.MustCompile(`^(\s*image:\s*)(\S+)(\s*)$`)
+	// autoReleaseRE matches the commit messages flux writes for automated
+	// releases, which name one image or list several.
+	autoReleaseRE = regexp.MustCompile(`^Auto-release (?:(\S+)|multiple \((\d+)\) images\n\n((?: - \S+\n)+))\n?$`)
+)
+
+// containerImages returns the image of each container in a manifest, keyed
+// by container name.  It only understands manifests laid out like ours, with
+// each container's image following the line giving its name.
+func containerImages(manifest string) map[string]string {
+	images := make(map[string]string)
+	var container string
+	for _, line := range strings.Split(manifest, "\n") {
+		if m := containerNameRE.FindStringSubmatch(line); m != nil {
+			container = m[1]
+		} else if m := imageLineRE.FindStringSubmatch(line); m != nil && container != "" {
+			images[container] = m[2]
+		}
+	}
+	return images
+}
+
+// withImages returns manifest with the images of the given containers
+// replaced, and every other byte left as it was.
+func withImages(manifest string, images map[string]string) string {
+	lines := strings.Split(manifest, "\n")
+	var container string
+	for i, line := range lines {
+		if m := containerNameRE.FindStringSubmatch(line); m != nil {
+			container = m[1]
+		} else if m := imageLineRE.FindStringSubmatch(line); m != nil {
+			if img, ok := images[container]; ok {
+				lines[i] = m[1] + img + m[3]
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseAutoReleaseMessage returns the images named in the message of a flux
+// automation commit, or an error if it doesn't look like one.
+func parseAutoReleaseMessage(msg string) ([]string, error) {
+	m := autoReleaseRE.FindStringSubmatch(msg)
+	if m == nil {
+		return nil, fmt.Errorf("commit message %q is not an automated release", msg)
+	}
+	if m[1] != "" {
+		return []string{m[1]}, nil
+	}
+	var images []string
+	for _, line := range strings.Split(strings.TrimSpace(m[3]), "\n") {
+		images = append(images, strings.TrimPrefix(strings.TrimSpace(line), "- "))
+	}
+	if fmt.Sprint(len(images)) != m[2] {
+		return nil, fmt.Errorf("commit message %q claims %s images but lists %d", msg, m[2], len(images))
+	}
+	return images, nil
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testManifest = `apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: helloworld
+spec:
+  template:
+    spec:
+      containers:
+      - name: helloworld
+        image: quay.io/weaveworks/helloworld:master-a000001
+        args:
+        - -msg=Ahoy
+      - name: sidecar
+        image: quay.io/weaveworks/sidecar:master-a000001
+`
+
+func TestContainerImages(t *testing.T) {
+	got := containerImages(testManifest)
+	want := map[string]string{
+		"helloworld": "quay.io/weaveworks/helloworld:master-a000001",
+		"sidecar":    "quay.io/weaveworks/sidecar:master-a000001",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("containerImages() = %v, want %v", got, want)
+	}
+}
+
+func TestWithImages(t *testing.T) {
+	got := withImages(testManifest, map[string]string{"sidecar": "quay.io/weaveworks/sidecar:master-a000002"})
+	want := strings.Replace(testManifest, "sidecar:master-a000001", "sidecar:master-a000002", 1)
+	if got != want {
+		t.Errorf("withImages() = %q, want %q", got, want)
+	}
+	if got := withImages(testManifest, nil); got != testManifest {
+		t.Errorf("withImages(nil) changed the manifest to %q", got)
+	}
+}
+
+func TestParseAutoReleaseMessage(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want []string
+	}{
+		{"Auto-release quay.io/weaveworks/helloworld:master-07a1b6b\n",
+			[]string{"quay.io/weaveworks/helloworld:master-07a1b6b"}},
+		{"Auto-release quay.io/weaveworks/helloworld:master-07a1b6b",
+			[]string{"quay.io/weaveworks/helloworld:master-07a1b6b"}},
+		{"Auto-release multiple (2) images\n\n - quay.io/a:1\n - quay.io/b:2\n",
+			[]string{"quay.io/a:1", "quay.io/b:2"}},
+		{"Auto-release multiple (3) images\n\n - quay.io/a:1\n - quay.io/b:2\n", nil},
+		{"Release quay.io/a:1 to default:deployment/helloworld\n", nil},
+		{"deploy", nil},
+	} {
+		got, err := parseAutoReleaseMessage(tc.msg)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("parseAutoReleaseMessage(%q) = %v, want error", tc.msg, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseAutoReleaseMessage(%q) = %v, %v; want %v", tc.msg, got, err, tc.want)
+		}
+	}
+}
@@ -1,41 +1,39 @@
 package test
 
 import (
-	"context"
 	"fmt"
 	"strings"
 )
 
 const (
 	minikubeProfile = "minikube"
-	minikubeVersion = "v0.28.1"
-	k8sVersion      = "v1.10.6" // need post-1.9.4 due to https://github.com/kubernetes/kubernetes/issues/61076; need 1.10+ due to https://github.com/kubernetes/minikube/issues/3028.
 )
 
 type (
 	minikubeTool struct {
+		bin     string
 		profile string
 	}
 
-	minikubeAPI interface {
-		version() string
-		delete()
-		start()
-	}
-
+	// minikube is a clusterAPI for a cluster run by minikube in its own
+	// profile.
 	minikube struct {
 		mt minikubeTool
-		lg logger
-	}
-
-	clusterAPI interface {
-		loadDockerImage(string)
-		nodeIP() string
+		// driver is the --vm-driver to start with, empty for minikube's
+		// default.
+		driver string
+		// dt is the host's docker, which images are loaded from.
+		dt dockerTool
+		// kt is used to ask the node which container runtime it has.
+		kt kubectlTool
+		// scp copies images onto the node when it's reached over ssh.
+		scp string
+		lg  logger
 	}
 )
 
 func (mt minikubeTool) common() []string {
-	return []string{"minikube", "--profile", mt.profile}
+	return []string{mt.bin, "--profile", mt.profile}
 }
 
 func (mt minikubeTool) versionCmd() []string {
@@ -58,54 +56,156 @@ func (mt minikubeTool) dockerEnvCmd() []string {
 	return append(mt.common(), "docker-env")
 }
 
-func newMinikubeTool(profile string) (*minikubeTool, error) {
-	return &minikubeTool{profile: profile}, nil
+func (mt minikubeTool) sshCmd(cmd string) []string {
+	return append(mt.common(), "ssh", "--", cmd)
 }
 
-func mustNewMinikube(lg logger, profile string) minikube {
-	mt, err := newMinikubeTool(profile)
+func (mt minikubeTool) sshKeyCmd() []string {
+	return append(mt.common(), "ssh-key")
+}
+
+// scpCmd is the command line that copies the host's file src to dst on the
+// node at ip, as the docker user minikube VMs have.
+func scpCmd(scp, key, ip, src, dst string) []string {
+	return []string{scp, "-i", key, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null",
+		src, "docker@" + ip + ":" + dst}
+}
+
+func newMinikubeTool(bin string, profile string) (*minikubeTool, error) {
+	return &minikubeTool{bin: bin, profile: profile}, nil
+}
+
+func mustNewMinikube(lg logger, bin string, profile string, driver string) minikube {
+	mt, err := newMinikubeTool(bin, profile)
 	if err != nil {
 		lg.Fatalf("%v", err)
 	}
 
-	m := minikube{mt: *mt, lg: lg}
-	version := strings.TrimSpace(m.version())
-	if version != fmt.Sprintf("minikube version: %s", minikubeVersion) {
-		lg.Fatalf("`minikube version` returned %q, but these tests only support version %s",
-			version, minikubeVersion)
+	m := minikube{
+		mt:     *mt,
+		driver: driver,
+		dt:     dockerTool{bin: "docker"},
+		kt:     kubectlTool{bin: "kubectl", profile: profile},
+		scp:    "scp",
+		lg:     lg,
 	}
+	version := strings.TrimSpace(m.version())
+	minikubeCompat.mustCheck(lg, strings.TrimPrefix(version, "minikube version: "))
 	return m
 }
 
 func (m minikube) cli() clicmd {
-	return newCli(m.lg, nil)
+	return newCli(m.logger(), nil)
+}
+
+func (m minikube) logger() logger {
+	return withFields(m.lg, "tool", "minikube")
+}
+
+func (m minikube) name() string {
+	return "minikube"
 }
 
 func (m minikube) version() string {
-	return m.cli().must(context.Background(), m.mt.versionCmd()...)
+	ctx, cancel := opContext("minikube.version")
+	defer cancel()
+	return m.cli().must(ctx, m.mt.versionCmd()...)
 }
 
 func (m minikube) delete() {
-	m.cli().run(context.Background(), m.mt.deleteCmd()...)
+	ctx, cancel := opContext("minikube.delete")
+	defer cancel()
+	m.cli().run(ctx, m.mt.deleteCmd()...)
 }
 
-func (m minikube) start(driver string) {
+func (m minikube) start() {
 	var args []string
-	if driver != "" {
-		args = append(args, []string{"--vm-driver", driver}...)
+	if m.driver != "" {
+		args = append(args, []string{"--vm-driver", m.driver}...)
 	}
-	m.cli().must(context.Background(), append(m.mt.startCmd(),
+	ctx, cancel := opContext("minikube.start")
+	defer cancel()
+	newStreamingCli(m.logger(), nil).must(ctx, append(m.mt.startCmd(),
 		append(args, []string{
 			"--bootstrapper", "kubeadm",
-			"--keep-context", "--kubernetes-version", k8sVersion}...)...)...)
+			"--keep-context", "--kubernetes-version", kubernetesCompat.preferred}...)...)...)
 }
 
+// loadDockerImage copies the image from the host's docker into the node's
+// container runtime, unless it already has an image of the same ID.
 func (m minikube) loadDockerImage(imageName string) {
-	shcmd := fmt.Sprintf(`docker save %s | (eval $(%s) && docker load)`, imageName,
-		strings.Join(m.mt.dockerEnvCmd(), " "))
-	m.cli().must(context.Background(), "sh", "-c", shcmd)
+	r, err := m.nodeRuntime()
+	if err != nil {
+		m.lg.Fatalf("Unable to load %s into minikube: %v", imageName, err)
+	}
+	if err := r.load(imageName); err != nil {
+		m.lg.Fatalf("Unable to load %s into minikube's %s: %v", imageName, r.kind, err)
+	}
+}
+
+// nodeRuntime returns a nodeRuntime for the container runtime the node
+// reports.  With the none driver that's on the host; otherwise it's reached
+// via docker-env for docker and minikube ssh for the rest, with images
+// copied onto the node with scp.
+func (m minikube) nodeRuntime() (nodeRuntime, error) {
+	ctx, cancel := opContext("kubectl.get")
+	out, err := m.cli().run(ctx, append(m.kt.common(), "get", "nodes", "-o", nodeRuntimeJSONPath)...)
+	cancel()
+	if err != nil {
+		return nodeRuntime{}, err
+	}
+	kind, err := parseContainerRuntime(out)
+	if err != nil {
+		return nodeRuntime{}, err
+	}
+
+	r := nodeRuntime{kind: kind, dt: m.dt, lg: m.logger()}
+	switch {
+	case m.driver == "none":
+		r.onNode = func(cmd string) []string { return []string{"sh", "-c", cmd} }
+	case kind == "docker":
+		r.onNode = func(cmd string) []string {
+			return []string{"sh", "-c", fmt.Sprintf("eval $(%s) && %s", shellJoin(m.mt.dockerEnvCmd()), cmd)}
+		}
+	default:
+		ctx, cancel := opContext("minikube.ssh-key")
+		key, err := m.cli().run(ctx, m.mt.sshKeyCmd()...)
+		cancel()
+		if err != nil {
+			return nodeRuntime{}, err
+		}
+		ctx, cancel = opContext("minikube.ip")
+		ip, err := m.cli().run(ctx, m.mt.ipCmd()...)
+		cancel()
+		if err != nil {
+			return nodeRuntime{}, err
+		}
+		key, ip = strings.TrimSpace(key), strings.TrimSpace(ip)
+		r.onNode = m.mt.sshCmd
+		r.copyCmd = func(src, dst string) []string {
+			return scpCmd(m.scp, key, ip, src, dst)
+		}
+	}
+	return r, nil
 }
 
 func (m minikube) nodeIP() string {
-	return strings.TrimSpace(m.cli().must(context.Background(), m.mt.ipCmd()...))
+	ctx, cancel := opContext("minikube.ip")
+	defer cancel()
+	return strings.TrimSpace(m.cli().must(ctx, m.mt.ipCmd()...))
+}
+
+// kubeconfig is the default: minikube runs without KUBECONFIG, so that's
+// where it puts its context.
+func (m minikube) kubeconfig() string {
+	return ""
+}
+
+func (m minikube) kubeContext() string {
+	return m.mt.profile
+}
+
+func (m minikube) withLogger(lg logger) clusterAPI {
+	m.lg = lg
+	return m
 }
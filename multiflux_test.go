@@ -0,0 +1,110 @@
+// +build integration_test
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	// secondFluxRelease is a flux release installed alongside the usual one.
+	secondFluxRelease = "cd2"
+	secondFluxPort    = 30081
+	instanceConfigMap = "flux-instance-test"
+)
+
+// installSecondFlux installs another flux, without a helm operator, syncing
+// from our repo as opts say.  The caller should delete it when done.
+func (h *harness) installSecondFlux(opts harnessOptions) {
+	h.helmAPI.delete(secondFluxRelease, true)
+	h.helmAPI.mustInstall(fluxNamespace, secondFluxRelease, "helm/charts/weave-flux",
+		append([]string{fmt.Sprintf("service.nodePort=%d", secondFluxPort)},
+			h.fluxChartValues(opts, defaultPollInterval)...)...)
+}
+
+// writeInstanceConfigMap writes a configmap manifest holding version to
+// path in the repo.
+func (h *harness) writeInstanceConfigMap(path string, version string) {
+	h.t.Helper()
+	dir := filepath.Join(h.repodir, path)
+	h.must(os.MkdirAll(dir, 0755))
+	manifest := fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  namespace: %s
+data:
+  version: %q
+`, instanceConfigMap, appNamespace, version)
+	h.must(ioutil.WriteFile(filepath.Join(dir, instanceConfigMap+".yaml"), []byte(manifest), 0644))
+}
+
+// waitForInstanceConfigMap waits for the configmap written by
+// writeInstanceConfigMap to have the given version in the cluster.
+func (h *harness) waitForInstanceConfigMap(ctx context.Context, version string) {
+	h.t.Helper()
+	k := global.kubectlAPI.withLogger(h.lg)
+	h.must(until(ctx, func(ictx context.Context) error {
+		got, err := k.get(appNamespace, "configmap", instanceConfigMap, "-o", "jsonpath={.data.version}")
+		if err != nil {
+			return err
+		}
+		if got != version {
+			return fmt.Errorf("configmap %s has version %q, want %q", instanceConfigMap, got, version)
+		}
+		return nil
+	}))
+}
+
+// TestMultipleFluxInstances runs two fluxes against the same repo, each with
+// its own path and sync tag, and checks they progress independently.
+func TestMultipleFluxInstances(t *testing.T) {
+	h := newharnessWith(t, harnessOptions{gitPath: "cluster-a", syncTag: "flux-sync-a"})
+	// Deferred first so that artifacts are collected before it's deleted.
+	defer h.helmAPI.delete(secondFluxRelease, true)
+	defer h.done()
+	second := harnessOptions{branch: h.branch, gitPath: "cluster-b", syncTag: "flux-sync-b"}
+	h.applyFlux()
+	h.installSecondFlux(second)
+
+	// Start with one commit deploying to both.
+	_, err := writeHelloWorldDeployment(h.manifestDir(), helloworldImageTag, sidecarImageTag)
+	h.must(err)
+	h.writeInstanceConfigMap(second.gitPath, "v1")
+	h.mustAddCommitPush()
+	ctx, cancel := context.WithTimeout(h.ctx, syncTimeout)
+	h.waitForSyncTag(ctx, second.syncTag, "HEAD")
+	h.waitForInstanceConfigMap(ctx, "v1")
+	cancel()
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+
+	// A change under the second flux's path moves both sync tags, but only
+	// the second flux applies anything.
+	h.writeInstanceConfigMap(second.gitPath, "v2")
+	h.mustAddCommitPush()
+	ctx, cancel = context.WithTimeout(h.ctx, syncTimeout)
+	h.waitForSyncTag(ctx, second.syncTag, "HEAD")
+	h.waitForInstanceConfigMap(ctx, "v2")
+	cancel()
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+
+	// With the first flux gone, the second carries on alone and the first
+	// sync tag stays where it was.
+	firstRev, err := h.resolve(h.syncTag)
+	h.must(err)
+	h.must(h.helmAPI.delete(helmFluxRelease, true))
+	h.writeInstanceConfigMap(second.gitPath, "v3")
+	h.mustAddCommitPush()
+	ctx, cancel = context.WithTimeout(h.ctx, syncTimeout)
+	h.waitForSyncTag(ctx, second.syncTag, "HEAD")
+	h.waitForInstanceConfigMap(ctx, "v3")
+	cancel()
+	if rev, err := h.resolve(h.syncTag); err != nil || rev != firstRev {
+		t.Errorf("Sync tag %s of deleted flux moved from %s to %s (err=%v)", h.syncTag, firstRev, rev, err)
+	}
+}
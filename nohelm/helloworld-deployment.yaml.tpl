@@ -12,13 +12,13 @@ spec:
     spec:
       containers:
       - name: helloworld
-        image: quay.io/weaveworks/helloworld:{{ .ImageTag }}
+        image: quay.io/weaveworks/helloworld:{{ .HelloworldImageTag }}
         args:
         - -msg=Ahoy
         ports:
         - containerPort: 80
       - name: sidecar
-        image: quay.io/weaveworks/sidecar:{{ .ImageTag }}
+        image: quay.io/weaveworks/sidecar:{{ .SidecarImageTag }}
         args:
         - -addr=:8080
         ports:
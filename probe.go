@@ -0,0 +1,73 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+type (
+	// probeAPI makes the network requests tests use to check on services
+	// in the cluster.  Each request is run as a command of a pseudo-tool,
+	// net or the API's name, so that it's audited and recorded or replayed
+	// like a tool invocation.  Polling is left to the caller.
+	probeAPI interface {
+		// dial succeeds if a TCP connection can be made to addr.
+		dial(ctx context.Context, addr string) error
+		// get returns the body of the response to a GET of url.
+		get(ctx context.Context, url string) (string, error)
+		// call makes an API request with f, whose result is decoded into v.
+		// args describe the request, starting with the API's name.
+		call(ctx context.Context, v interface{}, f func(context.Context) (interface{}, error), args ...string) error
+		// withLogger returns a copy that logs to lg.
+		withLogger(lg logger) probeAPI
+	}
+
+	// prober implements probeAPI.
+	prober struct {
+		lg logger
+	}
+)
+
+func newProber(lg logger) prober {
+	return prober{lg: lg}
+}
+
+func (p prober) withLogger(lg logger) probeAPI {
+	p.lg = lg
+	return p
+}
+
+func (p prober) dial(ctx context.Context, addr string) error {
+	_, err := runInProcess(ctx, p.lg, func(ctx context.Context) (string, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		return "", conn.Close()
+	}, "net", "dial", addr)
+	return err
+}
+
+func (p prober) get(ctx context.Context, url string) (string, error) {
+	return runInProcess(ctx, p.lg, func(ctx context.Context) (string, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := auditLogFrom(ctx).httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}, "net", "get", url)
+}
+
+func (p prober) call(ctx context.Context, v interface{}, f func(context.Context) (interface{}, error), args ...string) error {
+	return runInProcessJSON(ctx, p.lg, v, f, args...)
+}
@@ -0,0 +1,246 @@
+// +build integration_test
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/flux/image"
+)
+
+const (
+	// racePushInterval is how long the race driver's pusher waits between
+	// user pushes, so as not to bury automation in commits.
+	racePushInterval = 500 * time.Millisecond
+	// raceMinEdits is the least number of user edits the race driver pushes,
+	// however quickly automation finishes.
+	raceMinEdits = 5
+)
+
+type (
+	// userEdit makes the i'th change a simulated user pushes while flux is
+	// automating.  It's applied to a fresh checkout of upstream, so must
+	// not depend on earlier edits being present locally.  It runs off the
+	// test goroutine, so reports failure by returning an error.
+	userEdit func(h *harness, i int) error
+)
+
+var msgArgRE = regexp.MustCompile(`-msg=.*`)
+
+// editNotes is a user edit that doesn't touch anything flux changes.
+func editNotes(h *harness, i int) error {
+	return ioutil.WriteFile(filepath.Join(h.repodir, raceNotesFile(i)), []byte(fmt.Sprintf("edit %d\n", i)), 0644)
+}
+
+func raceNotesFile(i int) string {
+	return fmt.Sprintf("NOTES-%d", i)
+}
+
+// editHelloworldMsg is a user edit to the same manifest automation updates.
+func editHelloworldMsg(h *harness, i int) error {
+	path := filepath.Join(h.manifestDir(), helloworldManifest)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	content = msgArgRE.ReplaceAll(content, []byte(raceMsgArg(i)))
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+func raceMsgArg(i int) string {
+	return fmt.Sprintf("-msg=Ahoy from edit %d", i)
+}
+
+// pushUserEdit applies edit on top of upstream and pushes it, starting
+// again from the new upstream whenever the push is rejected because flux
+// got there first.  It returns the hash of the commit pushed.  Any other
+// failure is returned at once.
+func (h *harness) pushUserEdit(ctx context.Context, i int, edit userEdit) (string, error) {
+	for attempt := 1; ; attempt++ {
+		if err := h.fetch(); err != nil {
+			return "", err
+		}
+		if err := h.reset(h.upstreamRef()); err != nil {
+			return "", err
+		}
+		if err := edit(h, i); err != nil {
+			return "", fmt.Errorf("Unable to make user edit %d: %v", i, err)
+		}
+		rev, err := h.addCommit(fmt.Sprintf("user edit %d", i))
+		if err != nil {
+			return "", err
+		}
+		err = h.push(h.branch)
+		if err == nil {
+			return rev, nil
+		}
+		if !pushRejected(err) {
+			return "", fmt.Errorf("Unable to push user edit %d: %v", i, err)
+		}
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("Unable to push user edit %d before timing out: %v", i, err)
+		}
+		h.lg.Logf("push of user edit %d rejected (attempt %d), retrying: %v", i, attempt, err)
+	}
+}
+
+// automationDone returns nil once upstream has the images automation
+// updates to.
+func (h *harness) automationDone() error {
+	if err := h.fetch(); err != nil {
+		return err
+	}
+	manifest, err := h.show(h.upstreamRef(), h.manifestPath(helloworldManifest))
+	if err != nil {
+		return err
+	}
+	return checkAutomatedImages(manifest)
+}
+
+func checkAutomatedImages(manifest string) error {
+	images := containerImages(manifest)
+	want := map[string]string{
+		"helloworld": image.Ref{Name: helloworldImageName, Tag: automatedHelloworldImageTag}.String(),
+		"sidecar":    image.Ref{Name: sidecarImageName, Tag: automatedSidecarImageTag}.String(),
+	}
+	for container, img := range want {
+		if images[container] != img {
+			return fmt.Errorf("container %s has image %s, want %s", container, images[container], img)
+		}
+	}
+	return nil
+}
+
+// raceAutomation enables automation and, from another goroutine, keeps
+// pushing user edits until automation has updated the images upstream,
+// returning the commits pushed.
+func (h *harness) raceAutomation(ctx context.Context, edit userEdit) []string {
+	h.t.Helper()
+	h.automate()
+
+	var (
+		// gitMu serializes use of our clone by the pusher and the check
+		// for automation being done.
+		gitMu    sync.Mutex
+		pushed   []string
+		stop     = make(chan struct{})
+		pushDone = make(chan error, 1)
+	)
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	defer cancelWait()
+	go func() {
+		defer cancelWait()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				if i >= raceMinEdits {
+					pushDone <- nil
+					return
+				}
+			default:
+			}
+			gitMu.Lock()
+			rev, err := h.pushUserEdit(ctx, i, edit)
+			gitMu.Unlock()
+			if err != nil {
+				pushDone <- err
+				return
+			}
+			pushed = append(pushed, rev)
+			time.Sleep(racePushInterval)
+		}
+	}()
+
+	err := until(waitCtx, func(context.Context) error {
+		gitMu.Lock()
+		defer gitMu.Unlock()
+		return h.automationDone()
+	})
+	close(stop)
+	if pushErr := <-pushDone; pushErr != nil {
+		h.t.Fatal(pushErr)
+	}
+	if err != nil {
+		h.t.Fatalf("Automation didn't finish in time: %v", err)
+	}
+	h.lg.Logf("pushed %d user edits while automation ran", len(pushed))
+	return pushed
+}
+
+// verifyRace checks that none of the pushed user commits were lost, and
+// that the sync tag ends up on a commit with both the automation changes
+// and those checked by userChanges.
+func (h *harness) verifyRace(ctx context.Context, pushed []string, userChanges func(rev string) error) {
+	h.t.Helper()
+	h.waitForSync(ctx, h.upstreamRef())
+	for _, rev := range pushed {
+		missing, err := h.countCommits(h.upstreamRef(), rev)
+		h.must(err)
+		if missing != 0 {
+			h.t.Errorf("User commit %s was lost from %s", rev, h.branch)
+		}
+	}
+	manifest, err := h.show(h.syncTag, h.manifestPath(helloworldManifest))
+	h.must(err)
+	if err := checkAutomatedImages(manifest); err != nil {
+		h.t.Errorf("Automation changes missing at %s: %v", h.syncTag, err)
+	}
+	if err := userChanges(h.syncTag); err != nil {
+		h.t.Errorf("User changes missing at %s: %v", h.syncTag, err)
+	}
+}
+
+func (h *harness) setupRace(t *testing.T) (context.Context, context.CancelFunc) {
+	h.applyFlux()
+	h.deployViaGit(context.TODO())
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+	return context.WithTimeout(h.ctx, automationUpdateTimeout)
+}
+
+// TestAutomationRaceNonConflicting pushes edits to files automation doesn't
+// touch while it's updating images.
+func TestAutomationRaceNonConflicting(t *testing.T) {
+	h := newharness(t)
+	defer h.done()
+	ctx, cancel := h.setupRace(t)
+	defer cancel()
+
+	pushed := h.raceAutomation(ctx, editNotes)
+	h.verifyRace(ctx, pushed, func(rev string) error {
+		for i := range pushed {
+			if _, err := h.show(rev, raceNotesFile(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TestAutomationRaceConflicting pushes edits to the manifest automation is
+// updating, while it's updating it.
+func TestAutomationRaceConflicting(t *testing.T) {
+	h := newharness(t)
+	defer h.done()
+	ctx, cancel := h.setupRace(t)
+	defer cancel()
+
+	pushed := h.raceAutomation(ctx, editHelloworldMsg)
+	h.verifyRace(ctx, pushed, func(rev string) error {
+		manifest, err := h.show(rev, h.manifestPath(helloworldManifest))
+		if err != nil {
+			return err
+		}
+		if want := raceMsgArg(len(pushed) - 1); !strings.Contains(manifest, want+"\n") {
+			return fmt.Errorf("manifest doesn't have the last edit %q:\n%s", want, manifest)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,213 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// readinessCheck is a condition the cluster has to meet before the
+	// tests can use it.  check returns nil once the condition holds, and
+	// otherwise an error saying what's still pending.
+	readinessCheck struct {
+		name  string
+		check func(k kubectl) error
+	}
+)
+
+const (
+	nodeReadyJSONPath = `jsonpath={range .items[*]}{.metadata.name}={.status.conditions[?(@.type=="Ready")].status}{"\n"}{end}`
+	deployJSONPath    = `jsonpath={range .items[*]}{.metadata.name}={.status.availableReplicas}/{.spec.replicas}{"\n"}{end}`
+	dnsEndpointsPath  = `jsonpath={.subsets[*].addresses[*].ip}`
+
+	// dnsCheckImage runs the lookup in checkDNSLookup.  Later busybox
+	// nslookups fail against kube-dns, see
+	// https://github.com/docker-library/busybox/issues/48.
+	dnsCheckImage = "busybox:1.28"
+	dnsCheckPod   = "fluxtest-dns-check"
+	// dnsCheckName is looked up by checkDNSLookup; it's the API server's
+	// service, which every cluster has.
+	dnsCheckName = "kubernetes.default"
+)
+
+var (
+	// readinessPollInterval is how often a pending check is retried.
+	readinessPollInterval = 2 * time.Second
+
+	// clusterReadinessChecks are run in order, each waiting for the one
+	// before it to pass.
+	clusterReadinessChecks = []readinessCheck{
+		{"api server reachable", checkAPIServer},
+		{"nodes ready", checkNodesReady},
+		{"kube-system deployments available", checkSystemDeployments},
+		{"kube-dns endpoints ready", checkDNSEndpoints},
+		{"default service account present", checkDefaultServiceAccount},
+	}
+
+	// clusterDNSChecks run a pod, so are run after clusterReadinessChecks
+	// once dnsCheckImage is available to the cluster.
+	clusterDNSChecks = []readinessCheck{
+		{"cluster dns resolving", checkDNSLookup},
+	}
+)
+
+func checkAPIServer(k kubectl) error {
+	out, err := k.get("", "--raw", "/healthz")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) != "ok" {
+		return fmt.Errorf("healthz returned %q", strings.TrimSpace(out))
+	}
+	return nil
+}
+
+func checkNodesReady(k kubectl) error {
+	out, err := k.get("", "nodes", "-o", nodeReadyJSONPath)
+	if err != nil {
+		return err
+	}
+	return parseNodeReadiness(out)
+}
+
+func checkSystemDeployments(k kubectl) error {
+	out, err := k.get("kube-system", "deployments", "-o", deployJSONPath)
+	if err != nil {
+		return err
+	}
+	return parseDeploymentAvailability(out)
+}
+
+// checkDNSEndpoints waits for the kube-dns service, which fronts both
+// kube-dns and CoreDNS, to have a ready pod behind it.
+func checkDNSEndpoints(k kubectl) error {
+	out, err := k.get("kube-system", "endpoints", "kube-dns", "-o", dnsEndpointsPath)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) == "" {
+		return fmt.Errorf("kube-dns has no ready endpoints")
+	}
+	return nil
+}
+
+// checkDNSLookup looks up dnsCheckName from a pod, so that we know names
+// resolve rather than only that there's a DNS server.
+func checkDNSLookup(k kubectl) error {
+	// Clear away any pod left by an interrupted attempt.
+	k.delete("default", "pod", dnsCheckPod, "--ignore-not-found")
+	out, err := k.run("default", dnsCheckPod, dnsCheckImage, "nslookup", dnsCheckName)
+	if err != nil {
+		return err
+	}
+	return parseDNSLookup(out)
+}
+
+// parseDNSLookup takes the output of nslookup dnsCheckName and returns an
+// error unless it resolved.
+func parseDNSLookup(out string) error {
+	if !strings.Contains(out, dnsCheckName+".svc") {
+		return fmt.Errorf("%s didn't resolve: %s", dnsCheckName, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// checkDefaultServiceAccount waits for the service account controller, since
+// pods can't be created in a namespace until it has made one.
+func checkDefaultServiceAccount(k kubectl) error {
+	_, err := k.get("default", "serviceaccount", "default", "-o", "name")
+	return err
+}
+
+// parseNodeReadiness takes lines of name=status, giving each node's Ready
+// condition, and returns an error naming the nodes that aren't ready.
+func parseNodeReadiness(out string) error {
+	var nodes, pending []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		nodes = append(nodes, parts[0])
+		if len(parts) != 2 || parts[1] != "True" {
+			pending = append(pending, parts[0])
+		}
+	}
+	if len(nodes) == 0 {
+		return fmt.Errorf("no nodes registered")
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("nodes not ready: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// parseDeploymentAvailability takes lines of name=available/desired and
+// returns an error naming the deployments short of their desired replicas.
+func parseDeploymentAvailability(out string) error {
+	var deployments, pending []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		deployments = append(deployments, parts[0])
+		var counts []string
+		if len(parts) == 2 {
+			counts = strings.SplitN(parts[1], "/", 2)
+		}
+		if len(counts) != 2 {
+			pending = append(pending, parts[0])
+			continue
+		}
+		// availableReplicas is omitted while it's zero.
+		available, _ := strconv.Atoi(counts[0])
+		desired, err := strconv.Atoi(counts[1])
+		if err != nil || available < desired {
+			pending = append(pending, fmt.Sprintf("%s (%s)", parts[0], parts[1]))
+		}
+	}
+	if len(deployments) == 0 {
+		return fmt.Errorf("no deployments in kube-system yet")
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("deployments not available: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// waitForClusterReady runs checks in turn, polling each until it passes.
+// If ctx expires first the error names the pending check and why.
+func waitForClusterReady(ctx context.Context, k kubectl, checks []readinessCheck) error {
+	start := time.Now()
+	for _, c := range checks {
+		for attempt := 1; ; attempt++ {
+			err := c.check(k)
+			if err == nil {
+				k.lg.Logf("cluster readiness: %s after %v", c.name, time.Since(start).Round(time.Second))
+				break
+			}
+			debugf(k.lg, "cluster readiness: waiting for %s (attempt %d): %v", c.name, attempt, err)
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("cluster not ready after %v, still waiting for %s: %v",
+					time.Since(start).Round(time.Second), c.name, err)
+			case <-time.After(readinessPollInterval):
+			}
+		}
+	}
+	return nil
+}
+
+// mustWaitForClusterReady waits for checks to pass within the cluster.ready
+// timeout.
+func mustWaitForClusterReady(k kubectl, checks []readinessCheck) {
+	ctx, cancel := opContext("cluster.ready")
+	defer cancel()
+	if err := waitForClusterReady(ctx, k, checks); err != nil {
+		k.lg.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNodeReadiness(t *testing.T) {
+	for _, tc := range []struct {
+		out  string
+		want string
+	}{
+		{"minikube=True\n", ""},
+		{"a=True\nb=False\nc=\n", "nodes not ready: b, c"},
+		{"", "no nodes registered"},
+	} {
+		err := parseNodeReadiness(tc.out)
+		if (err == nil) != (tc.want == "") || (err != nil && err.Error() != tc.want) {
+			t.Errorf("parseNodeReadiness(%q) = %v, want %q", tc.out, err, tc.want)
+		}
+	}
+}
+
+func TestParseDeploymentAvailability(t *testing.T) {
+	for _, tc := range []struct {
+		out  string
+		want string
+	}{
+		{"kube-dns=1/1\ntiller-deploy=1/1\n", ""},
+		{"kube-dns=/1\nscaled-down=/0\n", "deployments not available: kube-dns (/1)"},
+		{"kube-dns=1/2\n", "deployments not available: kube-dns (1/2)"},
+		{"\n", "no deployments in kube-system yet"},
+	} {
+		err := parseDeploymentAvailability(tc.out)
+		if (err == nil) != (tc.want == "") || (err != nil && err.Error() != tc.want) {
+			t.Errorf("parseDeploymentAvailability(%q) = %v, want %q", tc.out, err, tc.want)
+		}
+	}
+}
+
+func TestParseDNSLookup(t *testing.T) {
+	resolved := "Server:    10.96.0.10\nAddress 1: 10.96.0.10 kube-dns.kube-system.svc.cluster.local\n\n" +
+		"Name:      kubernetes.default\nAddress 1: 10.96.0.1 kubernetes.default.svc.cluster.local\n"
+	if err := parseDNSLookup(resolved); err != nil {
+		t.Errorf("parseDNSLookup(resolved) = %v", err)
+	}
+	failed := "Server:    10.96.0.10\nAddress 1: 10.96.0.10\n\nnslookup: can't resolve 'kubernetes.default'\n"
+	if err := parseDNSLookup(failed); err == nil || !strings.Contains(err.Error(), "can't resolve") {
+		t.Errorf("parseDNSLookup(failed) = %v, want an error quoting nslookup", err)
+	}
+}
+
+func TestCheckDNSLookup(t *testing.T) {
+	defer func(d time.Duration) { readinessPollInterval = d }(readinessPollInterval)
+	readinessPollInterval = time.Millisecond
+	kt := kubectlTool{bin: "kubectl", profile: fakeProfile}
+	k := kubectl{kt: kt, lg: t}
+	deleteLeftover := append(kt.deleteCmd("default"), "pod", dnsCheckPod, "--ignore-not-found")
+	lookup := kt.runCmd("default", dnsCheckPod, dnsCheckImage, "nslookup", "kubernetes.default")
+
+	// The lookup is retried until it resolves.
+	f := newFakeCli(t)
+	f.expect(deleteLeftover...)
+	f.expect(lookup...).fails("nslookup: can't resolve 'kubernetes.default'")
+	f.expect(deleteLeftover...)
+	f.expect(lookup...).returns("Name:      kubernetes.default\n" +
+		"Address 1: 10.96.0.1 kubernetes.default.svc.cluster.local\n")
+	defer f.install()()
+	if err := waitForClusterReady(context.Background(), k, clusterDNSChecks); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWaitForClusterReady(t *testing.T) {
+	defer func(d time.Duration) { readinessPollInterval = d }(readinessPollInterval)
+	readinessPollInterval = time.Millisecond
+	kt := kubectlTool{bin: "kubectl", profile: fakeProfile}
+	k := kubectl{kt: kt, lg: t}
+	nodes := append(kt.getCmd(""), "nodes", "-o", nodeReadyJSONPath)
+
+	f := newFakeCli(t)
+	f.expect(append(kt.getCmd(""), "--raw", "/healthz")...).fails("connection refused")
+	f.expect(append(kt.getCmd(""), "--raw", "/healthz")...).returns("ok")
+	f.expect(nodes...).returns("minikube=False\n")
+	f.expect(nodes...).returns("minikube=True\n")
+	f.expect(append(kt.getCmd("kube-system"), "deployments", "-o", deployJSONPath)...).returns("kube-dns=1/1\n")
+	f.expect(append(kt.getCmd("kube-system"), "endpoints", "kube-dns", "-o", dnsEndpointsPath)...).returns("172.17.0.2")
+	f.expect(append(kt.getCmd("default"), "serviceaccount", "default", "-o", "name")...).returns("serviceaccount/default")
+	restore := f.install()
+	if err := waitForClusterReady(context.Background(), k, clusterReadinessChecks); err != nil {
+		t.Error(err)
+	}
+	restore()
+
+	// A check that never passes is reported by name when time runs out.
+	readinessPollInterval = time.Hour
+	f = newFakeCli(t)
+	f.expect(append(kt.getCmd(""), "--raw", "/healthz")...).returns("ok")
+	f.expectMatch("nodes", func(args []string) bool { return strings.Join(args, " ") == strings.Join(nodes, " ") }).
+		returns("minikube=False\n")
+	defer f.install()()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := waitForClusterReady(ctx, k, clusterReadinessChecks)
+	if err == nil || !strings.Contains(err.Error(), "nodes ready") || !strings.Contains(err.Error(), "minikube") {
+		t.Errorf("waitForClusterReady() = %v, want an error naming the pending nodes", err)
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "<redacted>"
+
+type (
+	// redactor masks secrets in text.  Secrets are either literal values or
+	// the first capture group of a pattern.
+	redactor struct {
+		mu       sync.RWMutex
+		values   []string
+		patterns []*regexp.Regexp
+	}
+
+	// redactingLogger is a logger that redacts everything logged through it.
+	redactingLogger struct {
+		logger
+		r *redactor
+	}
+)
+
+var (
+	// secrets is the redactor applied to everything clicmd logs.
+	secrets = newRedactor(
+		// kubectl create secret --from-file identity=<private key>
+		`\bidentity=([^\s\]]+)`,
+		// GIT_SSH_COMMAND=ssh -i <private key>
+		`\bssh -i ([^\s\]]+)`,
+		// helm --set token=<weave cloud token>, and the like
+		`(?i)\b[\w.]*(?:token|password|secret)=([^\s,\]]+)`,
+	)
+)
+
+func newRedactor(patterns ...string) *redactor {
+	r := &redactor{}
+	for _, p := range patterns {
+		r.addPattern(regexp.MustCompile(p))
+	}
+	return r
+}
+
+// addSecret registers a literal value that must never be logged.
+func (r *redactor) addSecret(value string) {
+	if value == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = append(r.values, value)
+}
+
+// addPattern registers a regexp whose first capture group must never be
+// logged.
+func (r *redactor) addPattern(re *regexp.Regexp) {
+	if re.NumSubexp() < 1 {
+		panic(fmt.Sprintf("redaction pattern %q has no capture group", re))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patterns = append(r.patterns, re)
+}
+
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, v := range r.values {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	for _, re := range r.patterns {
+		var b strings.Builder
+		last := 0
+		for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+			if m[2] < 0 {
+				continue
+			}
+			b.WriteString(s[last:m[2]])
+			b.WriteString(redacted)
+			last = m[3]
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s
+}
+
+func (rl redactingLogger) Logf(s string, args ...interface{}) {
+	rl.logger.Helper()
+	rl.logger.Logf("%s", rl.r.redact(fmt.Sprintf(s, args...)))
+}
+
+func (rl redactingLogger) Errorf(s string, args ...interface{}) {
+	rl.logger.Helper()
+	rl.logger.Errorf("%s", rl.r.redact(fmt.Sprintf(s, args...)))
+}
+
+func (rl redactingLogger) Fatalf(s string, args ...interface{}) {
+	rl.logger.Helper()
+	rl.logger.Fatalf("%s", rl.r.redact(fmt.Sprintf(s, args...)))
+}
+
+func (rl redactingLogger) Debugf(s string, args ...interface{}) {
+	rl.logger.Helper()
+	debugf(rl.logger, "%s", rl.r.redact(fmt.Sprintf(s, args...)))
+}
+
+func (rl redactingLogger) Warnf(s string, args ...interface{}) {
+	rl.logger.Helper()
+	warnf(rl.logger, "%s", rl.r.redact(fmt.Sprintf(s, args...)))
+}
+
+func (rl redactingLogger) With(kv ...interface{}) leveledLogger {
+	return redactingLogger{logger: withFields(rl.logger, kv...), r: rl.r}
+}
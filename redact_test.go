@@ -0,0 +1,23 @@
+package test
+
+import (
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	r := newRedactor(`\bidentity=([^\s\]]+)`, `(?i)\b[\w.]*token=([^\s,\]]+)`)
+	r.addSecret("hunter2")
+
+	for _, tc := range []struct{ in, want string }{
+		{"[kubectl create secret generic flux-git-deploy --from-file identity=/tmp/ssh/id_rsa]",
+			"[kubectl create secret generic flux-git-deploy --from-file identity=<redacted>]"},
+		{"[helm install --set token=abc123,git.url=ssh://x]",
+			"[helm install --set token=<redacted>,git.url=ssh://x]"},
+		{"password is hunter2", "password is <redacted>"},
+		{"nothing to see", "nothing to see"},
+	} {
+		if got := r.redact(tc.in); got != tc.want {
+			t.Errorf("redact(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+type (
+	// retryRule describes which failures of a tool are transient, and how
+	// hard to try before giving up.
+	retryRule struct {
+		// transient patterns are matched against stderr and the error.
+		transient   []*regexp.Regexp
+		maxAttempts int
+		// backoff is the delay before the first retry; it doubles with each
+		// subsequent attempt, up to maxBackoff.
+		backoff    time.Duration
+		maxBackoff time.Duration
+	}
+
+	// retrier is an executor that reruns failed invocations of the executor
+	// it wraps when the failure matches the rule for the tool.
+	retrier struct {
+		e     executor
+		lg    logger
+		rules map[string]retryRule
+	}
+)
+
+var (
+	// defaultRetryRules are keyed by tool binary basename.
+	defaultRetryRules = map[string]retryRule{
+		"helm": {
+			transient: compileAll(
+				`could not find a ready tiller pod`,
+				`could not find tiller`,
+				`error forwarding port`,
+				`transport is closing`,
+				`connection refused`,
+			),
+			maxAttempts: 5,
+			backoff:     time.Second,
+			maxBackoff:  10 * time.Second,
+		},
+		"kubectl": {
+			transient: compileAll(
+				`connection refused`,
+				`Unable to connect to the server`,
+				`TLS handshake timeout`,
+				`the server is currently unable to handle the request`,
+			),
+			maxAttempts: 5,
+			backoff:     time.Second,
+			maxBackoff:  10 * time.Second,
+		},
+		"git": {
+			transient: compileAll(
+				`Connection reset by peer`,
+				`Connection refused`,
+				`Connection closed by`,
+				`(ssh|kex)_exchange_identification`,
+			),
+			maxAttempts: 3,
+			backoff:     time.Second,
+			maxBackoff:  5 * time.Second,
+		},
+		// go-git is the pseudo-tool nativeGit runs its operations as.
+		"go-git": {
+			transient: compileAll(
+				`connection reset by peer`,
+				`connection refused`,
+				`ssh: handshake failed`,
+			),
+			maxAttempts: 3,
+			backoff:     time.Second,
+			maxBackoff:  5 * time.Second,
+		},
+	}
+)
+
+func compileAll(patterns ...string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		res = append(res, regexp.MustCompile(p))
+	}
+	return res
+}
+
+// newRetryDecorator returns a function suitable for use in cliDecorators.
+func newRetryDecorator(rules map[string]retryRule) func(logger, []string, executor) executor {
+	return func(lg logger, env []string, e executor) executor {
+		return retrier{e: e, lg: lg, rules: rules}
+	}
+}
+
+// isTransient returns true if the failed result matches one of the rule's
+// transient patterns.
+func (rule retryRule) isTransient(res cmdResult) bool {
+	for _, re := range rule.transient {
+		if re.MatchString(res.Stderr) || re.MatchString(res.Err.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r retrier) exec(ctx context.Context, in string, args ...string) cmdResult {
+	r.lg.Helper()
+	rule, ok := r.rules[filepath.Base(args[0])]
+	if !ok {
+		return r.e.exec(ctx, in, args...)
+	}
+
+	backoff := rule.backoff
+	for attempt := 1; ; attempt++ {
+		res := r.e.exec(ctx, in, args...)
+		if res.Err == nil || attempt >= rule.maxAttempts || !rule.isTransient(res) {
+			return res
+		}
+
+		warnf(r.lg, "transient failure running %v (attempt %d of %d), retrying in %v: %v\nStderr:\n%s",
+			args, attempt, rule.maxAttempts, backoff, res.Err, res.Stderr)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return res
+		}
+
+		backoff *= 2
+		if backoff > rule.maxBackoff {
+			backoff = rule.maxBackoff
+		}
+	}
+}
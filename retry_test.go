@@ -0,0 +1,90 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+// flakyExecutor fails with the given stderr until it has been called okAfter
+// times.
+type flakyExecutor struct {
+	stderr  string
+	okAfter int
+	calls   *int
+}
+
+func (f flakyExecutor) exec(ctx context.Context, in string, args ...string) cmdResult {
+	*f.calls++
+	if *f.calls < f.okAfter {
+		return cmdResult{Args: args, Stderr: f.stderr, ExitCode: 1, Err: errors.New("exit status 1")}
+	}
+	return cmdResult{Args: args, Stdout: "ok"}
+}
+
+func TestRetrier(t *testing.T) {
+	rules := map[string]retryRule{
+		"helm": {
+			transient:   []*regexp.Regexp{regexp.MustCompile(`connection refused`)},
+			maxAttempts: 3,
+		},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		stderr    string
+		okAfter   int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"transient then ok", []string{"bin/helm", "version"}, "connection refused", 2, 2, false},
+		{"transient exhausted", []string{"helm", "version"}, "connection refused", 5, 3, true},
+		{"permanent", []string{"helm", "version"}, "no such release", 2, 1, true},
+		{"no rule", []string{"kubectl", "version"}, "connection refused", 2, 1, true},
+	} {
+		calls := 0
+		r := retrier{
+			e:     flakyExecutor{stderr: tc.stderr, okAfter: tc.okAfter, calls: &calls},
+			lg:    t,
+			rules: rules,
+		}
+		res := r.exec(context.Background(), "", tc.args...)
+		if calls != tc.wantCalls {
+			t.Errorf("%s: got %d calls, want %d", tc.name, calls, tc.wantCalls)
+		}
+		if (res.Err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error=%v", tc.name, res.Err, tc.wantErr)
+		}
+	}
+}
+
+func TestRunInProcessRetry(t *testing.T) {
+	saved := cliDecorators
+	defer func() { cliDecorators = saved }()
+	cliDecorators = []func(logger, []string, executor) executor{newRetryDecorator(map[string]retryRule{
+		"go-git": {transient: compileAll(`connection refused`), maxAttempts: 3},
+	})}
+
+	calls := 0
+	flaky := func(ctx context.Context) (string, error) {
+		if calls++; calls < 2 {
+			return "", errors.New("dial tcp 10.0.0.1:22: connect: connection refused")
+		}
+		return "ok", nil
+	}
+	out, err := runInProcess(context.Background(), t, flaky, "go-git", "fetch", "origin")
+	if out != "ok" || err != nil || calls != 2 {
+		t.Errorf("got %q, %v after %d calls; want ok after 2", out, err, calls)
+	}
+
+	calls = 0
+	permanent := func(ctx context.Context) (string, error) {
+		calls++
+		return "", errors.New("non-fast-forward update: refs/heads/master")
+	}
+	if _, err := runInProcess(context.Background(), t, permanent, "go-git", "push"); err == nil || calls != 1 {
+		t.Errorf("got %v after %d calls; want an error after 1", err, calls)
+	}
+}
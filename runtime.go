@@ -0,0 +1,136 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	// nodeRuntime loads images from the host's docker into the container
+	// runtime of a node.
+	nodeRuntime struct {
+		// kind is the runtime: docker, containerd or cri-o.
+		kind string
+		// onNode returns the command line that runs the shell command cmd
+		// where it can reach the runtime.
+		onNode func(cmd string) []string
+		// copyCmd returns the command line that copies the host's file src
+		// to dst on the node.  It's nil if the runtime reads the host's
+		// files, as with the none driver or docker via docker-env.
+		copyCmd func(src, dst string) []string
+		dt      dockerTool
+		lg      logger
+	}
+)
+
+const nodeRuntimeJSONPath = `jsonpath={.items[0].status.nodeInfo.containerRuntimeVersion}`
+
+// parseContainerRuntime returns the runtime named by a node's
+// containerRuntimeVersion, e.g. containerd for containerd://1.4.3.
+func parseContainerRuntime(version string) (string, error) {
+	kind := strings.SplitN(strings.TrimSpace(version), "://", 2)[0]
+	switch kind {
+	case "docker", "containerd", "cri-o":
+		return kind, nil
+	}
+	return "", fmt.Errorf("unsupported container runtime %q", strings.TrimSpace(version))
+}
+
+// shellQuote quotes s for use as a single word in sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (r nodeRuntime) cli() clicmd {
+	return newCli(withFields(r.lg, "tool", "runtime", "runtime", r.kind), nil)
+}
+
+// imageIDCmd is a shell command printing the ID of ref, i.e. its config
+// digest, which is the same whichever runtime has it.
+func (r nodeRuntime) imageIDCmd(ref string) string {
+	if r.kind == "docker" {
+		return fmt.Sprintf("%s image inspect --format '{{.Id}}' %s", r.dt.bin, shellQuote(ref))
+	}
+	return "sudo crictl images --quiet " + shellQuote(ref)
+}
+
+// importCmd is a shell command that imports the docker save tarball at
+// path.
+func (r nodeRuntime) importCmd(path string) string {
+	switch r.kind {
+	case "containerd":
+		return "sudo ctr -n k8s.io images import " + shellQuote(path)
+	case "cri-o":
+		return "sudo podman load --input " + shellQuote(path)
+	}
+	return r.dt.bin + " load --input " + shellQuote(path)
+}
+
+// loadCmds returns the command lines that load ref from the host's docker
+// into the runtime, by way of a tarball in the host directory dir: save it,
+// copy it onto the node if need be, then import it.  Each must succeed
+// before the next is run.
+func (r nodeRuntime) loadCmds(ref string, dir string) [][]string {
+	path := filepath.Join(dir, imageFileName(ref))
+	cmds := [][]string{r.dt.saveCmd(ref, path)}
+	if r.copyCmd == nil {
+		return append(cmds, r.onNode(r.importCmd(path)))
+	}
+	nodePath := "/tmp/" + imageFileName(ref)
+	return append(cmds, r.copyCmd(path, nodePath),
+		r.onNode(r.importCmd(nodePath)+" && rm -f "+shellQuote(nodePath)))
+}
+
+// imageID returns the ID of ref in the runtime, or an error if the runtime
+// doesn't have it.
+func (r nodeRuntime) imageID(ref string) (string, error) {
+	ctx, cancel := opContext("runtime.inspect")
+	defer cancel()
+	out, err := r.cli().run(ctx, r.onNode(r.imageIDCmd(ref))...)
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(strings.SplitN(strings.TrimSpace(out), "\n", 2)[0])
+	if id == "" {
+		return "", fmt.Errorf("%s has no image %s", r.kind, ref)
+	}
+	return id, nil
+}
+
+// load copies ref into the runtime, unless it already has an image of the
+// same ID as the host's docker.
+func (r nodeRuntime) load(ref string) error {
+	hostID, err := docker{dt: r.dt, lg: r.lg}.imageID(ref)
+	if err != nil {
+		return err
+	}
+	if id, err := r.imageID(ref); err == nil && id == hostID {
+		debugf(r.lg, "%s already has %s as %s", r.kind, ref, id)
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "fluxtest-image")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := opContext("runtime.load")
+	defer cancel()
+	cli := newStreamingCli(withFields(r.lg, "tool", "runtime", "runtime", r.kind), nil)
+	for _, cmd := range r.loadCmds(ref, dir) {
+		if _, err := cli.run(ctx, cmd...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseContainerRuntime(t *testing.T) {
+	for in, want := range map[string]string{
+		"docker://17.12.1-ce":  "docker",
+		"containerd://1.4.3\n": "containerd",
+		"cri-o://1.20.0":       "cri-o",
+	} {
+		if got, err := parseContainerRuntime(in); err != nil || got != want {
+			t.Errorf("parseContainerRuntime(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := parseContainerRuntime("rkt://1.30.0"); err == nil {
+		t.Errorf("parseContainerRuntime accepted rkt")
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	got := shellJoin([]string{"minikube", "ssh", "--", "echo 'hi'"})
+	if want := `'minikube' 'ssh' '--' 'echo '\''hi'\'''`; got != want {
+		t.Errorf("shellJoin() = %s, want %s", got, want)
+	}
+}
+
+func TestMinikubeNodeRuntime(t *testing.T) {
+	mt := minikubeTool{bin: "minikube", profile: fakeProfile}
+	kt := kubectlTool{bin: "kubectl", profile: fakeProfile}
+	nodes := append(kt.common(), "get", "nodes", "-o", nodeRuntimeJSONPath)
+	const (
+		ref     = "memcached:1.4.25"
+		tarball = "/tmp/img/memcached_1.4.25.tar"
+		key     = "/home/u/.minikube/machines/fakeprofile/id_rsa"
+		ip      = "192.168.99.100"
+	)
+	save := []string{"docker", "save", "--output", tarball, ref}
+	dockerEnv := "eval $('minikube' '--profile' 'fakeprofile' 'docker-env') && "
+	scp := []string{"scp", "-i", key, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null",
+		tarball, "docker@" + ip + ":/tmp/memcached_1.4.25.tar"}
+
+	for _, tc := range []struct {
+		driver, runtime string
+		// ssh is set if the node is reached with minikube ssh, which needs
+		// the node's ssh key and IP for copying images.
+		ssh       bool
+		wantIDCmd []string
+		wantLoad  [][]string
+	}{
+		{"virtualbox", "docker://17.12.1-ce", false,
+			[]string{"sh", "-c", dockerEnv + "docker image inspect --format '{{.Id}}' 'memcached:1.4.25'"},
+			[][]string{save, {"sh", "-c", dockerEnv + "docker load --input '" + tarball + "'"}}},
+		{"virtualbox", "containerd://1.4.3", true,
+			mt.sshCmd("sudo crictl images --quiet 'memcached:1.4.25'"),
+			[][]string{save, scp, mt.sshCmd("sudo ctr -n k8s.io images import '/tmp/memcached_1.4.25.tar' && " +
+				"rm -f '/tmp/memcached_1.4.25.tar'")}},
+		{"kvm2", "cri-o://1.20.0", true,
+			mt.sshCmd("sudo crictl images --quiet 'memcached:1.4.25'"),
+			[][]string{save, scp, mt.sshCmd("sudo podman load --input '/tmp/memcached_1.4.25.tar' && " +
+				"rm -f '/tmp/memcached_1.4.25.tar'")}},
+		{"none", "docker://17.12.1-ce", false,
+			[]string{"sh", "-c", "docker image inspect --format '{{.Id}}' 'memcached:1.4.25'"},
+			[][]string{save, {"sh", "-c", "docker load --input '" + tarball + "'"}}},
+		{"none", "containerd://1.4.3", false,
+			[]string{"sh", "-c", "sudo crictl images --quiet 'memcached:1.4.25'"},
+			[][]string{save, {"sh", "-c", "sudo ctr -n k8s.io images import '" + tarball + "'"}}},
+		{"none", "cri-o://1.20.0", false,
+			[]string{"sh", "-c", "sudo crictl images --quiet 'memcached:1.4.25'"},
+			[][]string{save, {"sh", "-c", "sudo podman load --input '" + tarball + "'"}}},
+	} {
+		m := minikube{mt: mt, driver: tc.driver, dt: dockerTool{bin: "docker"}, kt: kt, scp: "scp", lg: t}
+		f := newFakeCli(t)
+		f.expect(nodes...).returns(tc.runtime)
+		if tc.ssh {
+			f.expect(mt.sshKeyCmd()...).returns(key + "\n")
+			f.expect(mt.ipCmd()...).returns(ip + "\n")
+		}
+		restore := f.install()
+		r, err := m.nodeRuntime()
+		restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.onNode(r.imageIDCmd(ref)); !reflect.DeepEqual(got, tc.wantIDCmd) {
+			t.Errorf("%s on %s: image ID command = %q, want %q", tc.runtime, tc.driver, got, tc.wantIDCmd)
+		}
+		if got := r.loadCmds(ref, "/tmp/img"); !reflect.DeepEqual(got, tc.wantLoad) {
+			t.Errorf("%s on %s: load commands = %q, want %q", tc.runtime, tc.driver, got, tc.wantLoad)
+		}
+	}
+}
+
+func TestNodeRuntimeLoad(t *testing.T) {
+	mt := minikubeTool{bin: "minikube", profile: fakeProfile}
+	dt := dockerTool{bin: "docker"}
+	copyCmd := func(src, dst string) []string { return []string{"scp", src, "node:" + dst} }
+	r := nodeRuntime{kind: "containerd", onNode: mt.sshCmd, copyCmd: copyCmd, dt: dt, lg: t}
+	const ref = "memcached:1.4.25"
+
+	// An image the runtime has with the host's ID isn't loaded again.
+	f := newFakeCli(t)
+	f.expect(dt.imageIDCmd(ref)...).returns("sha256:aaa\n")
+	f.expect(mt.sshCmd(r.imageIDCmd(ref))...).returns("sha256:aaa\n")
+	restore := f.install()
+	if err := r.load(ref); err != nil {
+		t.Error(err)
+	}
+	restore()
+
+	// An image the runtime lacks is saved, copied onto the node and
+	// imported.
+	isSave := func(args []string) bool {
+		return len(args) == 5 && args[1] == "save" && args[4] == ref
+	}
+	isCopy := func(args []string) bool { return len(args) == 3 && args[0] == "scp" }
+	isImport := func(args []string) bool {
+		return strings.Contains(args[len(args)-1], "images import '/tmp/memcached_1.4.25.tar'")
+	}
+	f = newFakeCli(t)
+	f.expect(dt.imageIDCmd(ref)...).returns("sha256:aaa\n")
+	f.expect(mt.sshCmd(r.imageIDCmd(ref))...).returns("")
+	f.expectMatch("docker save", isSave)
+	f.expectMatch("scp", isCopy)
+	f.expectMatch("import", isImport)
+	restore = f.install()
+	if err := r.load(ref); err != nil {
+		t.Error(err)
+	}
+	restore()
+
+	// A failed save stops the load, rather than importing nothing.
+	f = newFakeCli(t)
+	f.expect(dt.imageIDCmd(ref)...).returns("sha256:aaa\n")
+	f.expect(mt.sshCmd(r.imageIDCmd(ref))...).returns("")
+	f.expectMatch("docker save", isSave).fails("Error: No such image")
+	defer f.install()()
+	if err := r.load(ref); err == nil {
+		t.Error("load succeeded although docker save failed")
+	}
+}
@@ -4,21 +4,20 @@ package test
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
-	"time"
 )
 
 const (
-	fluxImage         = "quay.io/weaveworks/flux:latest"
-	fluxOperatorImage = "quay.io/weaveworks/helm-operator:latest"
-	fluxNamespace     = "flux"
-	helmFluxRelease   = "cd"
-	helmGitRelease    = "git"
+	fluxNamespace   = "flux"
+	helmFluxRelease = "cd"
+	helmGitRelease  = "git"
 )
 
 type (
@@ -28,6 +27,21 @@ type (
 		testroot  string
 		profile   string
 		clusterIP string
+		tools     *toolchain
+		audits    *auditLogs
+		lg        *structLogger
+		// artifactsDir is where failed tests leave their artifact bundles.
+		artifactsDir string
+		// gitImpl selects the gitAPI implementation: "native" or "cli".
+		gitImpl string
+		// gitHTTPToken is the password for the git server's http endpoint.
+		gitHTTPToken string
+		// replaying is set when tools' output is served from transcripts,
+		// so files they would have written don't exist.
+		replaying bool
+		// loadsImages is set if the cluster provider loaded requiredImages
+		// into the cluster, rather than the cluster pulling them itself.
+		loadsImages bool
 		clusterAPI
 		kubectlAPI
 		helmAPI
@@ -40,15 +54,24 @@ var (
 	global *setup
 )
 
-func newsetup(profile string) *setup {
-	dir, err := ioutil.TempDir("", "fluxtest")
+// newsetup returns a setup whose workdir is dir, emptied first, or a new
+// tempdir if dir is empty.
+func newsetup(lg *structLogger, profile string, tools *toolchain, dir string) *setup {
+	var err error
+	if dir == "" {
+		dir, err = ioutil.TempDir("", "fluxtest")
+	} else if err = os.RemoveAll(dir); err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
 	if err != nil {
-		log.Fatalf("Error creating tempdir: %v", err)
+		lg.Fatalf("Error creating workdir: %v", err)
 	}
 
 	return &setup{
 		testroot: dir,
 		profile:  profile,
+		tools:    tools,
+		lg:       lg,
 	}
 }
 
@@ -60,7 +83,19 @@ func (s *setup) genSshPrivateKey() {
 	// Create ssh dir under workdir and generate ssh key
 	_ = os.Mkdir(s.sshDir(), 0700)
 	// pubkey := privkey + ".pub"
-	execNoErr(context.Background(), nil, "ssh-keygen", "-t", "rsa", "-N", "", "-f", s.sshKeyFilePrivate())
+	ctx, cancel := opContext("ssh-keygen")
+	defer cancel()
+	newCli(s.lg, nil).must(ctx, s.tools.path("ssh-keygen"), "-t", "rsa", "-N", "", "-f", s.sshKeyFilePrivate())
+}
+
+// genGitHTTPToken makes up a password for the git server's http endpoint.
+func (s *setup) genGitHTTPToken() {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		s.lg.Fatalf("Unable to generate git http token: %v", err)
+	}
+	s.gitHTTPToken = hex.EncodeToString(b)
+	secrets.addSecret(s.gitHTTPToken)
 }
 
 func (s *setup) sshDir() string {
@@ -81,25 +116,20 @@ func (s *setup) knownHostsPath() string {
 
 func (s *setup) must(err error) {
 	if err != nil {
-		log.Fatalf("%s", err)
+		s.lg.Fatalf("%s", err)
 	}
 }
 
-func setEnvPath() {
-	cwd, err := os.Getwd()
-	if err != nil {
-		log.Fatalf("cannot get working directory: %v", err)
-	}
-	envpath := os.Getenv("PATH")
-	if envpath == "" {
-		envpath = filepath.Join(cwd, "bin")
-	} else {
-		envpath = filepath.Join(cwd, "bin") + ":" + envpath
-	}
-	os.Setenv("PATH", envpath)
+func TestMain(m *testing.M) {
+	os.Exit(testMain(m))
 }
 
-func TestMain(m *testing.M) {
+// testMain does the work of TestMain and returns the exit code.  Setup
+// failures unwind rather than exiting, so deferred cleanup always runs.
+func testMain(m *testing.M) (code int) {
+	defer recoverFatal(&code)
+	lg := newSetupLogger()
+
 	var (
 		flagKeepWorkdir = flag.Bool("keep-workdir", false,
 			"don't delete workdir on exit")
@@ -109,39 +139,191 @@ func TestMain(m *testing.M) {
 			"minikube driver to use")
 		flagMinikubeProfile = flag.String("minikube-profile", "minikube",
 			"minikube profile to use, don't change until we have a fix for https://github.com/kubernetes/minikube/issues/2717")
+		flagTimeoutsFile = flag.String("tool-timeouts-file", "",
+			`JSON file mapping tool operations to timeouts, e.g. {"helm.install": "10m"}`)
+		flagEnvAllow = flag.String("env-allow", "",
+			"comma-separated variables that tools may inherit from our environment, default all but those denied")
+		flagEnvDeny = flag.String("env-deny", "",
+			"comma-separated variables that tools may not inherit from our environment, in addition to the defaults")
+		flagStream = flag.Bool("stream-output", false,
+			"log the output of every command as it runs, not just long-running ones")
+		flagRetry = flag.Bool("retry-transient", true,
+			"retry tool invocations that fail due to known transient errors")
+		flagAuditDir = flag.String("audit-dir", "",
+			"write per-test JSON-lines audit logs to this directory, default under the workdir")
+		flagArtifactsDir = flag.String("artifacts-dir", "artifacts",
+			"write a tarball of diagnostics for each failed test to this directory, empty to disable")
+		flagRecordDir = flag.String("record-transcripts", "",
+			"record every command run into per-test transcripts in this directory")
+		flagReplayDir = flag.String("replay-transcripts", "",
+			"replay commands from per-test transcripts in this directory instead of running them")
+		flagGitImpl = flag.String("git-impl", "native",
+			"git implementation to use: native (in-process go-git) or cli (the git binary)")
+		flagClusterProvider = flag.String("cluster-provider", "minikube",
+			"where to run the tests: minikube (a cluster in -minikube-profile) or kubeconfig (an existing cluster)")
+		flagKubeContext = flag.String("kube-context", "",
+			"kubeconfig context to use with -cluster-provider=kubeconfig, default the current context")
+		flagImageCache = flag.String("image-cache", "image-cache",
+			"keep the images the tests need as tarballs in this directory, empty to disable")
+		flagImagePull = flag.Bool("image-pull", true,
+			"pull images that are neither in docker nor the image cache; disable to run air-gapped")
 	)
+	flagToolPaths := toolPaths{}
+	flag.Var(flagToolPaths, "tool-path",
+		"comma-separated tool binary overrides, e.g. helm=/usr/local/bin/helm,fluxctl=../flux/fluxctl")
+	flag.Var(&minLogLevel, "log-level", "lowest level to log: debug, info, warn or error")
+	// Applied after -tool-timeouts-file, so they win over it.
+	flagTimeouts := newTimeoutOverrides()
+	flag.Var(flagTimeouts, "tool-timeouts",
+		"comma-separated tool operation timeouts, e.g. helm.install=10m,kubectl=1m; these override -tool-timeouts-file")
 	flag.Parse()
-	log.Printf("Testing with keep-workdir=%v, start-minikube=%v, minikube-driver=%v, minikube-profile=%v",
-		*flagKeepWorkdir, *flagStartMinikube, *flagMinikubeDriver, *flagMinikubeProfile)
+	lg.Logf("Testing with keep-workdir=%v, cluster-provider=%v, start-minikube=%v, minikube-driver=%v, minikube-profile=%v",
+		*flagKeepWorkdir, *flagClusterProvider, *flagStartMinikube, *flagMinikubeDriver, *flagMinikubeProfile)
+
+	if *flagTimeoutsFile != "" {
+		if err := toolTimeouts.load(*flagTimeoutsFile); err != nil {
+			lg.Fatalf("%v", err)
+		}
+	}
+	toolTimeouts.override(flagTimeouts)
+	var cancel context.CancelFunc
+	rootCtx, cancel = testDeadlineContext()
+	defer cancel()
 
-	setEnvPath()
+	childEnv.allow = setOf(strings.Split(*flagEnvAllow, ",")...)
+	for name := range setOf(strings.Split(*flagEnvDeny, ",")...) {
+		childEnv.deny[name] = true
+	}
+	streamOutput = *flagStream
+	if *flagRetry {
+		cliDecorators = append(cliDecorators, newRetryDecorator(defaultRetryRules))
+	}
 
-	global = newsetup(*flagMinikubeProfile)
+	var (
+		ts *transcripts
+		// workdir is left to newsetup unless replaying, when it must be
+		// the same every time.
+		workdir string
+		err     error
+	)
+	switch {
+	case *flagRecordDir != "" && *flagReplayDir != "":
+		lg.Fatalf("-record-transcripts and -replay-transcripts are mutually exclusive")
+	case *flagRecordDir != "":
+		ts, err = newTranscripts(*flagRecordDir, false)
+	case *flagReplayDir != "":
+		ts, err = newTranscripts(*flagReplayDir, true)
+		workdir = filepath.Join(os.TempDir(), "fluxtest-replay")
+	}
+	if err != nil {
+		lg.Fatalf("%v", err)
+	}
+	if ts != nil {
+		cliDecorators = append(cliDecorators, ts.decorate)
+	}
+
+	provider, err := lookupClusterProvider(*flagClusterProvider)
+	if err != nil {
+		lg.Fatalf("%v", err)
+	}
+	toolSpecs := append(append([]toolSpec(nil), requiredTools...), provider.tools...)
+	tools, err := newToolchain(toolSpecs, flagToolPaths, "bin")
+	if err != nil {
+		lg.Fatalf("%v", err)
+	}
+	if ts != nil {
+		for _, spec := range toolSpecs {
+			ts.substitute(tools.path(spec.name), "${TOOL:"+spec.name+"}")
+		}
+	}
+	if err := tools.verify(rootCtx, lg, toolSpecs); err != nil {
+		lg.Fatalf("%v", err)
+	}
+
+	// helm init installs the tiller matching the client, so that's the
+	// tiller image we need.
+	helmVersion, err := parseHelmVersionString(tools.versions["helm"])
+	if err != nil {
+		lg.Fatalf("%v", err)
+	}
+	helmCompat.mustCheck(lg, helmVersion)
+	images := imagesFor(helmVersion)
+	if provider.loadsImages {
+		cache, err := newImageCache(lg, *flagImageCache, docker{dt: dockerTool{bin: tools.path("docker")}, lg: lg})
+		if err != nil {
+			lg.Fatalf("%v", err)
+		}
+		// Fail before touching the cluster if any image can't be had.
+		if err := cache.ensureAll(images, *flagImagePull); err != nil {
+			lg.Fatalf("%v", err)
+		}
+	}
+
+	cluster := provider.new(lg, tools, clusterOptions{
+		minikubeProfile: *flagMinikubeProfile,
+		minikubeDriver:  *flagMinikubeDriver,
+		kubeContext:     *flagKubeContext,
+	})
+	global = newsetup(lg, cluster.kubeContext(), tools, workdir)
+	global.artifactsDir = *flagArtifactsDir
+	global.loadsImages = provider.loadsImages
+	global.replaying = *flagReplayDir != ""
+	switch *flagGitImpl {
+	case "native", "cli":
+		global.gitImpl = *flagGitImpl
+	default:
+		lg.Fatalf("unknown -git-impl %q, want native or cli", *flagGitImpl)
+	}
 	if !*flagKeepWorkdir {
 		defer global.clean()
 	}
 
+	auditDir := *flagAuditDir
+	if auditDir == "" {
+		auditDir = filepath.Join(global.testroot, "audit")
+	}
+	global.audits, err = newAuditLogs(auditDir)
+	if err != nil {
+		lg.Fatalf("%v", err)
+	}
+	defer global.audits.close()
+	// Audit the commands themselves rather than the outcome of any retries.
+	cliDecorators = append([]func(logger, []string, executor) executor{global.audits.decorate},
+		cliDecorators...)
+
 	global.genSshPrivateKey()
+	global.genGitHTTPToken()
+	if ts != nil {
+		ts.substitute(global.testroot, "${TESTROOT}")
+		ts.substitute(global.gitHTTPToken, "${GIT_HTTP_TOKEN}")
+	}
 
-	minikube := mustNewMinikube(stdLogger{}, *flagMinikubeProfile)
 	if *flagStartMinikube {
-		minikube.delete()
-		minikube.start(*flagMinikubeDriver)
-		// This sleep is a hack until we find a better way to determine
-		// when the cluster is stable.
-		time.Sleep(60 * time.Second)
+		cluster.delete()
+		cluster.start()
 	}
+	// Wait before mustNewKubectl, which needs the API server to check its
+	// version.
+	readyK := kubectl{
+		kt: kubectlTool{bin: tools.path("kubectl"), profile: cluster.kubeContext(), kubeconfig: cluster.kubeconfig()},
+		lg: lg,
+	}
+	mustWaitForClusterReady(readyK, clusterReadinessChecks)
 
-	global.clusterAPI = minikube
-	global.clusterIP = minikube.nodeIP()
-	global.kubectlAPI = mustNewKubectl(stdLogger{}, *flagMinikubeProfile)
-	global.helmAPI = mustNewHelm(stdLogger{}, *flagMinikubeProfile,
-		global.testroot, global.kubectlAPI)
-
-	if *flagMinikubeDriver != "none" {
-		global.loadDockerImage(fluxImage)
-		global.loadDockerImage(fluxOperatorImage)
+	if provider.loadsImages {
+		for _, img := range images {
+			cluster.loadDockerImage(img.ref)
+		}
 	}
+	// The DNS check runs a pod, so needs its image loaded.
+	mustWaitForClusterReady(readyK, clusterDNSChecks)
+
+	global.clusterAPI = cluster
+	global.clusterIP = cluster.nodeIP()
+	lg.Logf("using %s cluster: %s", cluster.name(), strings.TrimSpace(cluster.version()))
+	global.kubectlAPI = mustNewKubectl(lg, tools.path("kubectl"), cluster.kubeContext(), cluster.kubeconfig())
+	global.helmAPI = mustNewHelm(lg, tools.path("helm"), cluster.kubeContext(), cluster.kubeconfig(),
+		global.testroot, global.kubectlAPI)
 
 	global.kubectlAPI.create("", "namespace", fluxNamespace)
 
@@ -149,5 +331,5 @@ func TestMain(m *testing.M) {
 	// test, it won't interfere with upcoming tests.
 	global.helmAPI.delete(helmFluxRelease, true)
 
-	os.Exit(m.Run())
+	return m.Run()
 }
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// timeouts maps operations to the deadline allowed for them.  Operations
+	// are named "tool.operation", e.g. "helm.install"; lookups fall back to
+	// the tool name alone and then to the default.
+	timeouts struct {
+		byOp map[string]time.Duration
+		dflt time.Duration
+	}
+)
+
+var (
+	// rootCtx is the context all tool operations derive from.  TestMain
+	// arranges for it to expire shortly before the go test -timeout deadline.
+	rootCtx = context.Background()
+
+	// toolTimeouts is consulted by opContext.
+	toolTimeouts = newTimeouts()
+)
+
+func newTimeouts() *timeouts {
+	return &timeouts{
+		dflt: 60 * time.Second,
+		byOp: map[string]time.Duration{
+			"git":              30 * time.Second,
+			"git.clone":        30 * time.Second,
+			"kubectl":          30 * time.Second,
+			"kubectl.version":  10 * time.Second,
+			"kubectl.run":      90 * time.Second,
+			"minikube":         60 * time.Second,
+			"minikube.start":   15 * time.Minute,
+			"minikube.delete":  5 * time.Minute,
+			"cluster.ready":    10 * time.Minute,
+			"docker":           60 * time.Second,
+			"docker.pull":      10 * time.Minute,
+			"docker.save":      5 * time.Minute,
+			"docker.load":      5 * time.Minute,
+			"runtime":          60 * time.Second,
+			"runtime.load":     5 * time.Minute,
+			"helm":             60 * time.Second,
+			"helm.version":     tillerContactTimeout,
+			"helm.init":        tillerInitTimeout,
+			"helm.install":     5 * time.Minute,
+			"helm.upgrade":     5 * time.Minute,
+			"ssh-keygen":       10 * time.Second,
+			"ssh-keyscan":      10 * time.Second,
+			"fluxctl.automate": 30 * time.Second,
+		},
+	}
+}
+
+// newTimeoutOverrides returns an empty timeouts, for collecting timeouts
+// to apply to another with override.
+func newTimeoutOverrides() *timeouts {
+	return &timeouts{byOp: make(map[string]time.Duration)}
+}
+
+// override sets each of the per-operation timeouts in other.
+func (to *timeouts) override(other *timeouts) {
+	for op, d := range other.byOp {
+		to.byOp[op] = d
+	}
+}
+
+// get returns the timeout for op.
+func (to *timeouts) get(op string) time.Duration {
+	if d, ok := to.byOp[op]; ok {
+		return d
+	}
+	if i := strings.Index(op, "."); i > 0 {
+		if d, ok := to.byOp[op[:i]]; ok {
+			return d
+		}
+	}
+	return to.dflt
+}
+
+// String implements flag.Value.
+func (to *timeouts) String() string {
+	if to == nil {
+		return ""
+	}
+	var ops []string
+	for op, d := range to.byOp {
+		ops = append(ops, fmt.Sprintf("%s=%v", op, d))
+	}
+	sort.Strings(ops)
+	return strings.Join(ops, ",")
+}
+
+// Set implements flag.Value, accepting a comma-separated list of op=duration.
+func (to *timeouts) Set(s string) error {
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("timeout %q is not of the form op=duration", kv)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return fmt.Errorf("bad duration in timeout %q: %v", kv, err)
+		}
+		to.byOp[parts[0]] = d
+	}
+	return nil
+}
+
+// load reads a JSON object mapping op names to durations, e.g.
+// {"helm.install": "10m", "kubectl": "1m"}.
+func (to *timeouts) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read timeouts file: %v", err)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("unable to parse timeouts file %q: %v", path, err)
+	}
+	for op, v := range raw {
+		if err := to.Set(op + "=" + v); err != nil {
+			return fmt.Errorf("in timeouts file %q: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// opContext returns a context for running op, derived from rootCtx.
+func opContext(op string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(rootCtx, toolTimeouts.get(op))
+}
+
+// testDeadlineContext returns a context that expires a little before the
+// deadline implied by go test -timeout, so that a hung tool fails with an
+// error instead of the test binary being killed without diagnostics.  If
+// there is no such deadline the context never expires.
+func testDeadlineContext() (context.Context, context.CancelFunc) {
+	f := flag.Lookup("test.timeout")
+	if f == nil {
+		return context.WithCancel(context.Background())
+	}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return context.WithCancel(context.Background())
+	}
+	timeout, ok := getter.Get().(time.Duration)
+	if !ok || timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	margin := timeout / 10
+	if margin > 30*time.Second {
+		margin = 30 * time.Second
+	}
+	return context.WithTimeout(context.Background(), timeout-margin)
+}
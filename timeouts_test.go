@@ -0,0 +1,154 @@
+package test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsGet(t *testing.T) {
+	to := &timeouts{
+		dflt: time.Minute,
+		byOp: map[string]time.Duration{"helm": 2 * time.Minute, "helm.install": 5 * time.Minute},
+	}
+	for _, tc := range []struct {
+		op   string
+		want time.Duration
+	}{
+		{"helm.install", 5 * time.Minute},
+		{"helm.upgrade", 2 * time.Minute},
+		{"helm", 2 * time.Minute},
+		{"kubectl.get", time.Minute},
+		{"kubectl", time.Minute},
+	} {
+		if got := to.get(tc.op); got != tc.want {
+			t.Errorf("get(%q): got %v, want %v", tc.op, got, tc.want)
+		}
+	}
+}
+
+func TestTimeoutsSet(t *testing.T) {
+	to := newTimeouts()
+	if err := to.Set("helm.install=10m,kubectl=1m"); err != nil {
+		t.Fatal(err)
+	}
+	if got := to.get("helm.install"); got != 10*time.Minute {
+		t.Errorf("helm.install: got %v, want 10m", got)
+	}
+	if got := to.get("kubectl.get"); got != time.Minute {
+		t.Errorf("kubectl.get: got %v, want 1m", got)
+	}
+
+	for _, bad := range []string{"helm.install", "helm=soon", "helm=10m,kubectl"} {
+		if err := newTimeouts().Set(bad); err == nil {
+			t.Errorf("Set(%q): expected error", bad)
+		}
+	}
+}
+
+func TestTimeoutsLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"good", `{"helm.install": "10m", "git": "2m"}`, false},
+		{"bad json", `{"helm.install": 10}`, true},
+		{"bad duration", `{"helm.install": "forever"}`, true},
+	} {
+		path := filepath.Join(dir, tc.name+".json")
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		to := newTimeouts()
+		err := to.load(path)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && (to.get("helm.install") != 10*time.Minute || to.get("git.clone") != 30*time.Second ||
+			to.get("git.push") != 2*time.Minute) {
+			t.Errorf("%s: got %v", tc.name, to)
+		}
+	}
+	if err := newTimeouts().load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("missing file: expected error")
+	}
+}
+
+func TestTimeoutsOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "timeouts.json")
+	if err := ioutil.WriteFile(path, []byte(`{"helm.install": "10m", "git": "2m"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// As in TestMain: flags are parsed first but applied after the file.
+	flags := newTimeoutOverrides()
+	if err := flags.Set("helm.install=20m"); err != nil {
+		t.Fatal(err)
+	}
+	to := newTimeouts()
+	if err := to.load(path); err != nil {
+		t.Fatal(err)
+	}
+	to.override(flags)
+	for op, want := range map[string]time.Duration{
+		"helm.install": 20 * time.Minute,
+		"git.push":     2 * time.Minute,
+		"kubectl":      30 * time.Second,
+	} {
+		if got := to.get(op); got != want {
+			t.Errorf("%s: got %v, want %v", op, got, want)
+		}
+	}
+}
+
+func TestTestDeadlineContext(t *testing.T) {
+	f := flag.Lookup("test.timeout")
+	if f == nil {
+		t.Skip("test.timeout flag not registered")
+	}
+	saved := f.Value.String()
+	defer flag.Set("test.timeout", saved)
+
+	for _, tc := range []struct {
+		timeout string
+		// want is the expected time to the deadline, zero if none.
+		want time.Duration
+	}{
+		{"0", 0},
+		{"100s", 90 * time.Second},
+		{"10m", 10*time.Minute - 30*time.Second},
+	} {
+		if err := flag.Set("test.timeout", tc.timeout); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		ctx, cancel := testDeadlineContext()
+		deadline, ok := ctx.Deadline()
+		cancel()
+		switch {
+		case tc.want == 0 && ok:
+			t.Errorf("timeout %s: got deadline %v, want none", tc.timeout, deadline)
+		case tc.want == 0:
+		case !ok:
+			t.Errorf("timeout %s: got no deadline, want one in %v", tc.timeout, tc.want)
+		case deadline.Sub(start) < tc.want || deadline.Sub(start) > tc.want+time.Second:
+			t.Errorf("timeout %s: got deadline in %v, want %v", tc.timeout, deadline.Sub(start), tc.want)
+		}
+	}
+}
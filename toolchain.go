@@ -0,0 +1,145 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type (
+	// toolSpec describes an external tool the tests depend on.
+	toolSpec struct {
+		name string
+		// versionArgs print the tool's version, nil if it has no cheap way
+		// to do so.
+		versionArgs []string
+	}
+
+	// toolchain maps tool names to the absolute paths of their binaries.
+	toolchain struct {
+		paths    map[string]string
+		versions map[string]string
+	}
+
+	// toolPaths is a flag.Value holding name=path overrides.
+	toolPaths map[string]string
+)
+
+var requiredTools = []toolSpec{
+	{name: "git", versionArgs: []string{"--version"}},
+	{name: "kubectl", versionArgs: []string{"version", "--client"}},
+	{name: "helm", versionArgs: []string{"version", "--client"}},
+	{name: "yq", versionArgs: []string{"--version"}},
+	{name: "fluxctl", versionArgs: []string{"version"}},
+	{name: "ssh-keygen"},
+	{name: "ssh-keyscan"},
+}
+
+func (tp toolPaths) String() string {
+	var kvs []string
+	for name, path := range tp {
+		kvs = append(kvs, name+"="+path)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// Set implements flag.Value, accepting a comma-separated list of name=path.
+func (tp toolPaths) Set(s string) error {
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("tool path %q is not of the form name=path", kv)
+		}
+		tp[parts[0]] = parts[1]
+	}
+	return nil
+}
+
+// toolEnvVar returns the environment variable that may be used to give the
+// path of the named tool, e.g. FLUXTEST_SSH_KEYGEN for ssh-keygen.
+func toolEnvVar(name string) string {
+	return "FLUXTEST_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// resolveTool finds the named tool, looking in order at overrides, the
+// environment, bindir, and finally PATH.
+func resolveTool(name string, overrides map[string]string, bindir string) (string, error) {
+	candidate, source := overrides[name], "flag"
+	if candidate == "" {
+		candidate, source = os.Getenv(toolEnvVar(name)), toolEnvVar(name)
+	}
+	if candidate == "" {
+		if p := filepath.Join(bindir, name); isExecutable(p) {
+			candidate, source = p, "bindir"
+		}
+	}
+	if candidate == "" {
+		candidate, source = name, "PATH"
+	}
+
+	path, err := exec.LookPath(candidate)
+	if err != nil {
+		return "", fmt.Errorf("unable to find tool %q (from %s): %v", name, source, err)
+	}
+	return filepath.Abs(path)
+}
+
+func isExecutable(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir() && fi.Mode()&0111 != 0
+}
+
+func newToolchain(specs []toolSpec, overrides map[string]string, bindir string) (*toolchain, error) {
+	tc := &toolchain{paths: make(map[string]string), versions: make(map[string]string)}
+	var errs []string
+	for _, spec := range specs {
+		path, err := resolveTool(spec.name, overrides, bindir)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		tc.paths[spec.name] = path
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("missing tools:\n%s", strings.Join(errs, "\n"))
+	}
+	return tc, nil
+}
+
+// path returns the absolute path of the named tool.  Tools that weren't
+// registered are returned as-is, to be looked up in PATH.
+func (tc *toolchain) path(name string) string {
+	if p, ok := tc.paths[name]; ok {
+		return p
+	}
+	return name
+}
+
+// verify runs each tool that supports it to get its version, which is
+// recorded and logged, failing if any of them can't be run.
+func (tc *toolchain) verify(ctx context.Context, lg logger, specs []toolSpec) error {
+	c := newCli(lg, nil)
+	var errs []string
+	for _, spec := range specs {
+		if spec.versionArgs == nil {
+			continue
+		}
+		out, err := c.run(ctx, append([]string{tc.path(spec.name)}, spec.versionArgs...)...)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		version := strings.TrimSpace(strings.SplitN(strings.TrimSpace(out), "\n", 2)[0])
+		tc.versions[spec.name] = version
+		lg.Logf("using %s: %s", tc.path(spec.name), version)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("tool version checks failed:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveTool(t *testing.T) {
+	root, err := ioutil.TempDir("", "toolchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	const name = "fluxtest-fake-tool"
+	// mktool creates name in a new subdirectory of root, returning its path.
+	mktool := func(dir string, mode os.FileMode) string {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(root, dir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	var (
+		flagPath   = mktool("flag", 0755)
+		envPath    = mktool("env", 0755)
+		binPath    = mktool("bin", 0755)
+		pathPath   = mktool("path", 0755)
+		noexecPath = mktool("noexec", 0644)
+		emptyDir   = filepath.Join(root, "empty")
+	)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	defer os.Unsetenv(toolEnvVar(name))
+
+	for _, tc := range []struct {
+		desc     string
+		override string
+		env      string
+		bindir   string
+		path     string
+		want     string
+		wantErr  string
+	}{
+		{desc: "flag first", override: flagPath, env: envPath, bindir: filepath.Dir(binPath),
+			path: filepath.Dir(pathPath), want: flagPath},
+		{desc: "then env", env: envPath, bindir: filepath.Dir(binPath),
+			path: filepath.Dir(pathPath), want: envPath},
+		{desc: "then bindir", bindir: filepath.Dir(binPath), path: filepath.Dir(pathPath), want: binPath},
+		{desc: "then PATH", bindir: emptyDir, path: filepath.Dir(pathPath), want: pathPath},
+		{desc: "non-executable in bindir", bindir: filepath.Dir(noexecPath), path: filepath.Dir(pathPath),
+			want: pathPath},
+		{desc: "bad flag", override: filepath.Join(emptyDir, name), bindir: filepath.Dir(binPath),
+			wantErr: "from flag"},
+		{desc: "bad env", env: filepath.Join(emptyDir, name), bindir: filepath.Dir(binPath),
+			wantErr: "from " + toolEnvVar(name)},
+		{desc: "nowhere", bindir: emptyDir, path: emptyDir, wantErr: "from PATH"},
+	} {
+		os.Setenv("PATH", tc.path)
+		os.Setenv(toolEnvVar(name), tc.env)
+		overrides := map[string]string{}
+		if tc.override != "" {
+			overrides[name] = tc.override
+		}
+		got, err := resolveTool(name, overrides, tc.bindir)
+		switch {
+		case tc.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got %q, %v, want error containing %q", tc.desc, got, err, tc.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.desc, err)
+		case got != tc.want:
+			t.Errorf("%s: got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestToolEnvVar(t *testing.T) {
+	for name, want := range map[string]string{
+		"helm":       "FLUXTEST_HELM",
+		"ssh-keygen": "FLUXTEST_SSH_KEYGEN",
+	} {
+		if got := toolEnvVar(name); got != want {
+			t.Errorf("toolEnvVar(%q): got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestToolPathsSet(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    toolPaths
+		wantErr bool
+	}{
+		{in: "helm=/usr/local/bin/helm", want: toolPaths{"helm": "/usr/local/bin/helm"}},
+		{in: "helm=/h,fluxctl=../flux/fluxctl",
+			want: toolPaths{"helm": "/h", "fluxctl": "../flux/fluxctl"}},
+		{in: "yq=/a=b", want: toolPaths{"yq": "/a=b"}},
+		{in: "helm", wantErr: true},
+		{in: "=/usr/bin/helm", wantErr: true},
+		{in: "helm=", wantErr: true},
+		{in: "helm=/h,", wantErr: true},
+	} {
+		tp := toolPaths{}
+		err := tp.Set(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Set(%q): got error %v, want error %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(tp, tc.want) {
+			t.Errorf("Set(%q): got %v, want %v", tc.in, tp, tc.want)
+		}
+	}
+
+	tp := toolPaths{"kubectl": "/k", "helm": "/h"}
+	if got, want := tp.String(), "helm=/h,kubectl=/k"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+}
@@ -1,10 +1,18 @@
 package test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type (
@@ -16,83 +24,245 @@ type (
 		Helper()
 	}
 
+	// cmdResult is the outcome of a single tool invocation.
+	cmdResult struct {
+		// Path is the resolved path of the binary that was run.
+		Path     string
+		Args     []string
+		Stdout   string
+		Stderr   string
+		ExitCode int
+		Duration time.Duration
+		// Err is non-nil if the tool couldn't be started or exited non-zero.
+		Err error
+	}
+
+	// executor is the primitive that clicmd implementations build on.
+	executor interface {
+		// exec executes the tool feeding it input on stdin
+		exec(ctx context.Context, in string, args ...string) cmdResult
+	}
+
 	clicmd interface {
-		// run executes the tool and returns the result
+		executor
+		// run executes the tool and returns its stdout
 		run(ctx context.Context, args ...string) (string, error)
 		// input executes the tool feeding it input on stdin
 		input(ctx context.Context, in string, args ...string) (string, error)
-		// output executes the tool and returns the result, empty on failure
+		// output executes the tool and returns its stdout, empty on failure
 		output(ctx context.Context, args ...string) string
-		// must executes the tool and returns the result, dying on failure
+		// must executes the tool and returns its stdout, dying on failure
 		must(ctx context.Context, args ...string) string
 	}
 
+	// inProcess is an executor for an operation done in Go rather than by
+	// running a tool.  What it returns becomes the stdout of the result.
+	inProcess func(ctx context.Context) (string, error)
+
+	// cli implements clicmd on top of an executor.
+	cli struct {
+		executor
+		lg logger
+	}
+
 	cmdrunner struct {
+		// env is overlaid on the environment inherited according to childEnv.
 		env []string
 		lg  logger
+		// stream causes output to be logged line by line as it's produced.
+		stream bool
 	}
 
-	stdLogger struct{}
+	// lineLogger is an io.Writer that logs each complete line written to it.
+	lineLogger struct {
+		lg     logger
+		prefix string
+		buf    []byte
+	}
 )
 
-func (l stdLogger) Name() string {
-	return ""
+// streamOutput makes every clicmd behave as if created by newStreamingCli.
+var streamOutput bool
+
+// cliDecorators are applied in order to the executor behind every clicmd
+// returned by newCli, e.g. to record or replay transcripts.
+var cliDecorators []func(lg logger, env []string, e executor) executor
+
+func newCli(lg logger, env []string) clicmd {
+	return buildCli(cmdrunner{lg: lg, env: env, stream: streamOutput})
 }
 
-func (l stdLogger) Fatalf(s string, args ...interface{}) {
-	log.Fatalf(s, args...)
+// newStreamingCli is like newCli, but the clicmd logs stdout and stderr as
+// they're produced rather than only in case of failure.  Use it for
+// long-running commands.
+func newStreamingCli(lg logger, env []string) clicmd {
+	return buildCli(cmdrunner{lg: lg, env: env, stream: true})
 }
 
-func (l stdLogger) Errorf(s string, args ...interface{}) {
-	log.Printf("Error: "+s, args...)
+func buildCli(cr cmdrunner) clicmd {
+	cr.lg = redactingLogger{logger: cr.lg, r: secrets}
+	return decorated(cr.lg, cr.env, cr)
 }
 
-func (l stdLogger) Logf(s string, args ...interface{}) {
-	log.Printf(s, args...)
+// decorated returns a clicmd running e wrapped in the cliDecorators.
+func decorated(lg logger, env []string, e executor) clicmd {
+	for _, decorate := range cliDecorators {
+		e = decorate(lg, env, e)
+	}
+	return cli{executor: e, lg: lg}
 }
 
-func (l stdLogger) Helper() {}
+// runInProcess performs f as though it were the command args, so that it's
+// audited, retried and recorded or replayed like any tool invocation.
+// args[0] names the pseudo-tool for the retry rules, e.g. "go-git".  When
+// replaying transcripts f isn't called at all.
+func runInProcess(ctx context.Context, lg logger, f func(ctx context.Context) (string, error), args ...string) (string, error) {
+	lg = redactingLogger{logger: lg, r: secrets}
+	return decorated(lg, nil, inProcess(f)).run(ctx, args...)
+}
 
-func newCli(lg logger, env []string) clicmd {
-	return cmdrunner{lg: lg, env: env}
+// runInProcessJSON is like runInProcess, but for operations with structured
+// results, which are passed through as JSON and decoded into v.
+func runInProcessJSON(ctx context.Context, lg logger, v interface{}, f func(ctx context.Context) (interface{}, error), args ...string) error {
+	out, err := runInProcess(ctx, lg, func(ctx context.Context) (string, error) {
+		res, err := f(ctx)
+		if err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(res)
+		return string(b), err
+	}, args...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(out), v)
 }
 
-func stdCli() clicmd {
-	return newCli(stdLogger{}, nil)
+func (f inProcess) exec(ctx context.Context, in string, args ...string) cmdResult {
+	start := time.Now()
+	out, err := f(ctx)
+	res := cmdResult{Path: args[0], Args: args, Stdout: out, Duration: time.Since(start), Err: err}
+	if err != nil {
+		res.ExitCode = 1
+	}
+	return res
 }
 
-func (cr cmdrunner) run(ctx context.Context, args ...string) (string, error) {
-	return cr.input(ctx, "", args...)
+// err returns an error describing the failed invocation, or nil if it
+// succeeded.  Secrets are redacted from the message.
+func (r cmdResult) err() error {
+	if r.Err == nil {
+		return nil
+	}
+	return errors.New(secrets.redact(fmt.Sprintf(
+		"error running %v (exit code %d): %v\nStdout:\n%s\nStderr:\n%s",
+		r.Args, r.ExitCode, r.Err, r.Stdout, r.Stderr)))
 }
 
-func (cr cmdrunner) input(ctx context.Context, in string, args ...string) (string, error) {
+func (cr cmdrunner) exec(ctx context.Context, in string, args ...string) cmdResult {
 	cr.lg.Helper()
 	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-	cmd.Env = cr.env
-	if cmd.Env != nil {
-		cr.lg.Logf("running %v with env=%v", cmd.Args, cmd.Env)
+	cmd.Env = childEnv.build(os.Environ(), cr.env)
+	cmd.Stdin = strings.NewReader(in)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if cr.stream {
+		tool := filepath.Base(args[0])
+		outlg := &lineLogger{lg: cr.lg, prefix: tool + ": "}
+		errlg := &lineLogger{lg: cr.lg, prefix: tool + " (stderr): "}
+		cmd.Stdout = io.MultiWriter(&stdout, outlg)
+		cmd.Stderr = io.MultiWriter(&stderr, errlg)
+		defer outlg.flush()
+		defer errlg.flush()
+	}
+	if cr.env != nil {
+		cr.lg.Logf("running %v with env=%v", cmd.Args, cr.env)
 	} else {
 		cr.lg.Logf("running %v", cmd.Args)
 	}
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("error running %v: %v\nOutput:\n%s", cmd.Args, err, out)
+
+	start := time.Now()
+	err := cmd.Run()
+	res := cmdResult{
+		Path:     cmd.Path,
+		Args:     args,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	res.ExitCode = exitCode(cmd.ProcessState)
+	switch {
+	case err == nil:
+	case rootCtx.Err() != nil:
+		res.Err = fmt.Errorf("killed after %v because the go test -timeout deadline is near: %v",
+			res.Duration, err)
+	case ctx.Err() != nil:
+		res.Err = fmt.Errorf("killed after %v, timeout exceeded: %v", res.Duration, err)
+	}
+	return res
+}
+
+// exitCode returns the exit status of a finished process, or -1 if it
+// didn't start or was killed by a signal.
+func exitCode(ps *os.ProcessState) int {
+	if ps == nil {
+		return -1
+	}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok {
+		return ws.ExitStatus()
 	}
-	return string(out), err
+	if ps.Success() {
+		return 0
+	}
+	return -1
+}
+
+func (ll *lineLogger) Write(p []byte) (int, error) {
+	ll.buf = append(ll.buf, p...)
+	for {
+		i := bytes.IndexByte(ll.buf, '\n')
+		if i < 0 {
+			break
+		}
+		ll.lg.Logf("%s%s", ll.prefix, ll.buf[:i])
+		ll.buf = ll.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs any trailing partial line.
+func (ll *lineLogger) flush() {
+	if len(ll.buf) > 0 {
+		ll.lg.Logf("%s%s", ll.prefix, ll.buf)
+		ll.buf = nil
+	}
+}
+
+func (c cli) run(ctx context.Context, args ...string) (string, error) {
+	return c.input(ctx, "", args...)
+}
+
+func (c cli) input(ctx context.Context, in string, args ...string) (string, error) {
+	c.lg.Helper()
+	res := c.exec(ctx, in, args...)
+	return res.Stdout, res.err()
 }
 
-func (cr cmdrunner) output(ctx context.Context, args ...string) string {
-	out, err := cr.run(ctx, args...)
+func (c cli) output(ctx context.Context, args ...string) string {
+	out, err := c.run(ctx, args...)
 	if err != nil {
 		return ""
 	}
 	return out
 }
 
-func (cr cmdrunner) must(ctx context.Context, args ...string) string {
-	out, err := cr.run(ctx, args...)
+func (c cli) must(ctx context.Context, args ...string) string {
+	c.lg.Helper()
+	out, err := c.run(ctx, args...)
 	if err != nil {
-		cr.lg.Fatalf("%v", err)
+		c.lg.Fatalf("%v", err)
 	}
 	return out
 }
@@ -0,0 +1,20 @@
+package test
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCmdrunnerExitCode(t *testing.T) {
+	cr := cmdrunner{lg: t}
+	ctx := context.Background()
+	if res := cr.exec(ctx, "", "sh", "-c", "exit 3"); res.ExitCode != 3 || res.Err == nil {
+		t.Errorf("exit 3: got exit code %d, err %v", res.ExitCode, res.Err)
+	}
+	if res := cr.exec(ctx, "", "true"); res.ExitCode != 0 || res.Err != nil {
+		t.Errorf("true: got exit code %d, err %v", res.ExitCode, res.Err)
+	}
+	if res := cr.exec(ctx, "", "/nonexistent/tool"); res.ExitCode != -1 || res.Err == nil {
+		t.Errorf("missing tool: got exit code %d, err %v", res.ExitCode, res.Err)
+	}
+}
@@ -0,0 +1,275 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// transcriptEntry records a single clicmd invocation.
+	transcriptEntry struct {
+		Path     string        `json:"path,omitempty"`
+		Args     []string      `json:"args"`
+		Env      []string      `json:"env,omitempty"`
+		Stdin    string        `json:"stdin,omitempty"`
+		Stdout   string        `json:"stdout"`
+		Stderr   string        `json:"stderr,omitempty"`
+		ExitCode int           `json:"exitCode"`
+		Error    string        `json:"error,omitempty"`
+		Duration time.Duration `json:"duration"`
+	}
+
+	// transcript is the ordered list of invocations made on behalf of one
+	// logger, i.e. one test or the global setup.  It's stored as JSON lines.
+	transcript struct {
+		mu      sync.Mutex
+		path    string
+		entries []transcriptEntry
+		pos     int
+	}
+
+	// transcripts maps logger names to transcripts stored under dir.
+	transcripts struct {
+		mu           sync.Mutex
+		dir          string
+		replay       bool
+		byName       map[string]*transcript
+		placeholders []placeholder
+	}
+
+	// placeholder stands in for a value that differs from run to run, such
+	// as the workdir, so that a transcript can be replayed by a later run.
+	placeholder struct {
+		value string
+		name  string
+	}
+
+	// recorder is an executor that runs commands using the executor it wraps
+	// and appends each invocation to a transcript.
+	recorder struct {
+		e   executor
+		env []string
+		lg  logger
+		tr  *transcript
+		ts  *transcripts
+	}
+
+	// replayer is an executor that serves invocations from a transcript
+	// without running anything.
+	replayer struct {
+		lg logger
+		tr *transcript
+		ts *transcripts
+	}
+)
+
+func newTranscripts(dir string, replay bool) (*transcripts, error) {
+	if !replay {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create transcript dir %q: %v", dir, err)
+		}
+	}
+	return &transcripts{dir: dir, replay: replay, byName: make(map[string]*transcript)}, nil
+}
+
+// perTestFilename returns the filename with extension ext used for per-test
+// output on behalf of the logger with the given name.
+func perTestFilename(name string, ext string) string {
+	if name == "" {
+		name = "setup"
+	}
+	return strings.Replace(name, "/", "_", -1) + ext
+}
+
+func (ts *transcripts) get(name string) (*transcript, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if tr, ok := ts.byName[name]; ok {
+		return tr, nil
+	}
+
+	tr := &transcript{path: filepath.Join(ts.dir, perTestFilename(name, ".jsonl"))}
+	if ts.replay {
+		if err := tr.load(); err != nil {
+			return nil, err
+		}
+	} else if err := os.Remove(tr.path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to remove old transcript %q: %v", tr.path, err)
+	}
+	ts.byName[name] = tr
+	return tr, nil
+}
+
+// substitute arranges for value to be stored in transcripts as name, e.g.
+// "${TESTROOT}".  Replayed invocations are matched after the same
+// substitution, and name is expanded to this run's value in their output.
+func (ts *transcripts) substitute(value, name string) {
+	if value == "" {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.placeholders = append(ts.placeholders, placeholder{value: value, name: name})
+	// Longest first, so that a value containing another is replaced whole.
+	sort.SliceStable(ts.placeholders, func(i, j int) bool {
+		return len(ts.placeholders[i].value) > len(ts.placeholders[j].value)
+	})
+}
+
+// normalize replaces the values registered with substitute by their names,
+// then redacts secrets, so that nothing sensitive is written to disk.
+// Invocations being replayed are normalized too, so they still match.
+func (ts *transcripts) normalize(s string) string {
+	ts.mu.Lock()
+	for _, p := range ts.placeholders {
+		s = strings.Replace(s, p.value, p.name, -1)
+	}
+	ts.mu.Unlock()
+	return secrets.redact(s)
+}
+
+func (ts *transcripts) normalizeAll(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = ts.normalize(s)
+	}
+	return out
+}
+
+// expand undoes the substitutions made by normalize; redacted secrets stay
+// redacted.
+func (ts *transcripts) expand(s string) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, p := range ts.placeholders {
+		s = strings.Replace(s, p.name, p.value, -1)
+	}
+	return s
+}
+
+// decorate is suitable for use in cliDecorators: it returns a recorder or
+// replayer for the transcript belonging to lg.
+func (ts *transcripts) decorate(lg logger, env []string, e executor) executor {
+	tr, err := ts.get(lg.Name())
+	if err != nil {
+		lg.Fatalf("%v", err)
+	}
+	if ts.replay {
+		return replayer{lg: lg, tr: tr, ts: ts}
+	}
+	return recorder{e: e, env: env, lg: lg, tr: tr, ts: ts}
+}
+
+func (tr *transcript) load() error {
+	f, err := os.Open(tr.path)
+	if err != nil {
+		return fmt.Errorf("unable to open transcript: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var e transcriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("unable to parse transcript %q: %v", tr.path, err)
+		}
+		tr.entries = append(tr.entries, e)
+	}
+	return scanner.Err()
+}
+
+func (tr *transcript) append(e transcriptEntry) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tr.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write transcript: %v", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write transcript: %v", err)
+	}
+	tr.entries = append(tr.entries, e)
+	return f.Close()
+}
+
+// next returns the next entry, provided it matches the given invocation.
+func (tr *transcript) next(in string, args []string) (transcriptEntry, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.pos >= len(tr.entries) {
+		return transcriptEntry{}, fmt.Errorf("transcript %q exhausted, unexpected command %v",
+			tr.path, args)
+	}
+	e := tr.entries[tr.pos]
+	if !reflect.DeepEqual(e.Args, args) || e.Stdin != in {
+		return transcriptEntry{}, fmt.Errorf("transcript %q entry %d is %v, but got command %v",
+			tr.path, tr.pos, e.Args, args)
+	}
+	tr.pos++
+	return e, nil
+}
+
+func (r recorder) exec(ctx context.Context, in string, args ...string) cmdResult {
+	r.lg.Helper()
+	res := r.e.exec(ctx, in, args...)
+	e := transcriptEntry{
+		Path:     r.ts.normalize(res.Path),
+		Args:     r.ts.normalizeAll(args),
+		Env:      r.ts.normalizeAll(r.env),
+		Stdin:    r.ts.normalize(in),
+		Stdout:   r.ts.normalize(res.Stdout),
+		Stderr:   r.ts.normalize(res.Stderr),
+		ExitCode: res.ExitCode,
+		Duration: res.Duration,
+	}
+	if res.Err != nil {
+		e.Error = r.ts.normalize(res.Err.Error())
+	}
+	if err := r.tr.append(e); err != nil {
+		r.lg.Errorf("%v", err)
+	}
+	return res
+}
+
+func (r replayer) exec(ctx context.Context, in string, args ...string) cmdResult {
+	r.lg.Helper()
+	e, err := r.tr.next(r.ts.normalize(in), r.ts.normalizeAll(args))
+	if err != nil {
+		return cmdResult{Args: args, ExitCode: -1, Err: err}
+	}
+	debugf(r.lg, "replaying %v", args)
+	res := cmdResult{
+		Path:     r.ts.expand(e.Path),
+		Args:     args,
+		Stdout:   r.ts.expand(e.Stdout),
+		Stderr:   r.ts.expand(e.Stderr),
+		ExitCode: e.ExitCode,
+		Duration: e.Duration,
+	}
+	if e.Error != "" {
+		res.Err = errors.New(r.ts.expand(e.Error))
+	}
+	return res
+}
@@ -0,0 +1,338 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+)
+
+func TestTranscriptRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	rec, err := newTranscripts(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cli{executor: rec.decorate(t, nil, cmdrunner{lg: t}), lg: t}
+	if out := c.must(ctx, "echo", "hello"); out != "hello\n" {
+		t.Errorf("recording echo: got %q", out)
+	}
+	if out, _ := c.input(ctx, "piped", "cat"); out != "piped" {
+		t.Errorf("recording cat: got %q", out)
+	}
+	if _, err := c.run(ctx, "false"); err == nil {
+		t.Errorf("recording false: expected error")
+	}
+
+	rep, err := newTranscripts(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = cli{executor: rep.decorate(t, nil, nil), lg: t}
+	if out := c.must(ctx, "echo", "hello"); out != "hello\n" {
+		t.Errorf("replaying echo: got %q", out)
+	}
+	if _, err := c.input(ctx, "different", "cat"); err == nil {
+		t.Errorf("replaying cat with different stdin: expected mismatch error")
+	}
+	if out, _ := c.input(ctx, "piped", "cat"); out != "piped" {
+		t.Errorf("replaying cat: got %q", out)
+	}
+	if _, err := c.run(ctx, "false"); err == nil {
+		t.Errorf("replaying false: expected error")
+	}
+	if _, err := c.run(ctx, "true"); err == nil {
+		t.Errorf("replaying past end of transcript: expected error")
+	}
+}
+
+// TestTranscriptReplaySetup records the sort of commands run by setup, then
+// replays them as a later run would, with a different workdir, git http
+// token and tool paths.
+func TestTranscriptReplaySetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type run struct {
+		testroot, token, kubectl, helm, sshKeygen string
+	}
+	setupCmds := func(r run) [][]string {
+		return [][]string{
+			{r.sshKeygen, "-t", "rsa", "-N", "", "-f", r.testroot + "/ssh/id_rsa"},
+			{r.kubectl, "--context", fakeProfile, "-n", "flux", "create", "secret", "generic",
+				"flux-git-deploy", "--from-file", "identity=" + r.testroot + "/ssh/id_rsa"},
+			{r.helm, "--kube-context", fakeProfile, "--home", r.testroot + "/.helm", "install",
+				"--set", "git.url=http://flux:" + r.token + "@10.0.0.1:30443/repo.git", "helm/charts/weave-flux"},
+		}
+	}
+	register := func(ts *transcripts, r run) {
+		ts.substitute(r.kubectl, "${TOOL:kubectl}")
+		ts.substitute(r.helm, "${TOOL:helm}")
+		ts.substitute(r.sshKeygen, "${TOOL:ssh-keygen}")
+		ts.substitute(r.testroot, "${TESTROOT}")
+		ts.substitute(r.token, "${GIT_HTTP_TOKEN}")
+	}
+
+	ctx := context.Background()
+	recorded := run{"/tmp/fluxtest123", "0badc0de", "/home/me/flux-tester/bin/kubectl",
+		"/home/me/flux-tester/bin/helm", "/usr/bin/ssh-keygen"}
+	rec, err := newTranscripts(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(rec, recorded)
+	f := newFakeCli(t)
+	for _, args := range setupCmds(recorded) {
+		f.expect(args...).returns("wrote " + recorded.testroot + "/ssh/id_rsa.pub\n")
+	}
+	c := cli{executor: rec.decorate(t, nil, f), lg: t}
+	for _, args := range setupCmds(recorded) {
+		c.must(ctx, args...)
+	}
+	f.verify()
+	b, err := ioutil.ReadFile(filepath.Join(dir, perTestFilename(t.Name(), ".jsonl")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{recorded.testroot, recorded.token, recorded.helm} {
+		if strings.Contains(string(b), v) {
+			t.Errorf("transcript contains %q:\n%s", v, b)
+		}
+	}
+
+	replayed := run{"/tmp/fluxtest-replay", "5ca1ab1e", "/opt/bin/kubectl", "/opt/bin/helm",
+		"/usr/local/bin/ssh-keygen"}
+	rep, err := newTranscripts(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(rep, replayed)
+	c = cli{executor: rep.decorate(t, nil, nil), lg: t}
+	for _, args := range setupCmds(replayed) {
+		if out := c.must(ctx, args...); out != "wrote "+replayed.testroot+"/ssh/id_rsa.pub\n" {
+			t.Errorf("replaying %v: got %q", args, out)
+		}
+	}
+}
+
+// TestTranscriptReplayHarnessFlow records the sort of things a test does
+// through its harness: commands, go-git operations, port checks, HTTP
+// requests and flux API calls.  It then replays them as a later run would,
+// with a different workdir, kubectl and cluster address, and nothing
+// listening there or in the repo.
+func TestTranscriptReplayHarnessFlow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type (
+		run struct {
+			testroot, kubectl, addr string
+		}
+		service struct {
+			ID         string
+			Containers []string
+		}
+		results struct {
+			head, body, pods string
+			services         []service
+		}
+	)
+	register := func(ts *transcripts, r run) {
+		ts.substitute(r.kubectl, "${TOOL:kubectl}")
+		ts.substitute(r.testroot, "${TESTROOT}")
+		ts.substitute(r.addr, "${CLUSTER}")
+	}
+	// flow does the same things whether recording or replaying; only when
+	// recording are there files to commit.
+	flow := func(r run, recording bool) results {
+		t.Helper()
+		ctx := context.Background()
+		lg := newTestLogger(t)
+		k := kubectl{kt: kubectlTool{bin: r.kubectl, profile: fakeProfile}, lg: lg}
+		p := newProber(lg)
+		var (
+			res results
+			err error
+		)
+
+		if err := k.create("flux", "configmap", "ssh-public-keys",
+			"--from-file", "me.pub="+r.testroot+"/ssh/id_rsa.pub"); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.dial(ctx, r.addr); err != nil {
+			t.Fatal(err)
+		}
+
+		origin := filepath.Join(r.testroot, "origin.git")
+		if recording {
+			if _, err := gogit.PlainInit(origin, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		g := mustNewNativeGit(lg, filepath.Join(r.testroot, "repo"), nil, "file://"+origin, "master")
+		if recording {
+			if err := ioutil.WriteFile(filepath.Join(g.repodir, "helloworld.yaml"), []byte("kind: Deployment\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		g.mustAddCommitPush()
+		if res.head, err = g.resolve("HEAD"); err != nil {
+			t.Fatal(err)
+		}
+
+		if res.body, err = p.get(ctx, "http://"+r.addr+"/"); err != nil {
+			t.Fatal(err)
+		}
+		apiURL := "http://" + r.addr + "/api"
+		err = p.call(ctx, &res.services, func(ctx context.Context) (interface{}, error) {
+			req, err := http.NewRequest(http.MethodGet, apiURL+"/services", nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			var services []service
+			return services, json.NewDecoder(resp.Body).Decode(&services)
+		}, "flux-api", "list-services", apiURL, "demo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.pods, err = k.get("demo", "pods"); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	saved := cliDecorators
+	defer func() { cliDecorators = saved }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			w.Write([]byte("Ahoy\n"))
+		case "/api/services":
+			json.NewEncoder(w).Encode([]service{{ID: "demo:deployment/helloworld", Containers: []string{"helloworld", "sidecar"}}})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	recorded := run{filepath.Join(dir, "record"), "/home/me/flux-tester/bin/kubectl",
+		strings.TrimPrefix(srv.URL, "http://")}
+	transcriptDir := filepath.Join(dir, "transcripts")
+	if err := os.Mkdir(transcriptDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := newTranscripts(transcriptDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(rec, recorded)
+	kt := kubectlTool{bin: recorded.kubectl, profile: fakeProfile}
+	f := newFakeCli(t)
+	f.expect(append(kt.createCmd("flux"), "configmap", "ssh-public-keys",
+		"--from-file", "me.pub="+recorded.testroot+"/ssh/id_rsa.pub")...).
+		returns("configmap/ssh-public-keys created\n")
+	f.expect(append(kt.getCmd("demo"), "pods")...).returns("NAME           READY\nhelloworld-0   2/2\n")
+	// Only tools are faked; operations done in-process are recorded as is.
+	fakeTools := func(lg logger, env []string, e executor) executor {
+		if _, ok := e.(cmdrunner); ok {
+			return f
+		}
+		return e
+	}
+	cliDecorators = []func(logger, []string, executor) executor{fakeTools, rec.decorate}
+	want := flow(recorded, true)
+	srv.Close()
+	f.verify()
+	if want.body != "Ahoy\n" || len(want.services) != 1 || want.head == "" {
+		t.Fatalf("unexpected results recording: %+v", want)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(transcriptDir, perTestFilename(t.Name(), ".jsonl")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{recorded.testroot, recorded.kubectl, recorded.addr} {
+		if strings.Contains(string(b), v) {
+			t.Errorf("transcript contains %q:\n%s", v, b)
+		}
+	}
+
+	replayed := run{filepath.Join(dir, "replay"), "/opt/bin/kubectl", "10.0.0.1:30080"}
+	rep, err := newTranscripts(transcriptDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(rep, replayed)
+	cliDecorators = []func(logger, []string, executor) executor{rep.decorate}
+	if got := flow(replayed, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed results differ:\n got %+v\nwant %+v", got, want)
+	}
+	if _, err := os.Stat(replayed.testroot); !os.IsNotExist(err) {
+		t.Errorf("replay touched the workdir: %v", err)
+	}
+}
+
+func TestTranscriptRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	args := []string{"helm", "install", "--set", "token=s3cr3t"}
+	env := []string{"GIT_SSH_COMMAND=ssh -i /keys/id_rsa"}
+	rec, err := newTranscripts(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeCli(t)
+	f.expect(args...).fails("bad token=s3cr3t")
+	c := cli{executor: rec.decorate(t, env, f), lg: t}
+	c.input(ctx, "password=s3cr3t", args...)
+	f.verify()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, perTestFilename(t.Name(), ".jsonl")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"s3cr3t", "/keys/id_rsa"} {
+		if strings.Contains(string(b), v) {
+			t.Errorf("transcript contains %q:\n%s", v, b)
+		}
+	}
+
+	rep, err := newTranscripts(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = cli{executor: rep.decorate(t, nil, nil), lg: t}
+	if _, err := c.input(ctx, "password=s3cr3t", args...); err == nil ||
+		!strings.Contains(err.Error(), "bad token=") {
+		t.Errorf("replaying redacted command: got error %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+// +build integration_test
+
+package test
+
+import (
+	"context"
+	"testing"
+)
+
+// skipUnlessImagesLoaded skips tests that need the git http sidecar when
+// the cluster would have to pull it, since it isn't published anywhere.
+func skipUnlessImagesLoaded(t *testing.T) {
+	t.Helper()
+	if !global.loadsImages {
+		t.Skipf("the http git transport needs %s, which isn't published; the %s cluster provider can't load it from the host",
+			gitHTTPImage, global.clusterAPI.name())
+	}
+}
+
+// TestSyncHTTP is TestSync with flux and us using the git server's http
+// endpoint, with basic auth.
+func TestSyncHTTP(t *testing.T) {
+	skipUnlessImagesLoaded(t)
+	h := newharnessWith(t, harnessOptions{gitTransport: "http"})
+	defer h.done()
+	h.applyFlux()
+	h.deployViaGit(context.TODO())
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+}
+
+// TestSyncHTTPS is TestSync over https, with the git server using a
+// self-signed certificate.
+func TestSyncHTTPS(t *testing.T) {
+	skipUnlessImagesLoaded(t)
+	h := newharnessWith(t, harnessOptions{gitTransport: "https"})
+	defer h.done()
+	h.applyFlux()
+	h.deployViaGit(context.TODO())
+	h.verifySyncAndSvcs(t, "HEAD", helloworldImageTag, sidecarImageTag)
+}
@@ -5,13 +5,6 @@ package test
 import (
 	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"net"
-	"net/http"
-	"os/exec"
-	"strings"
 	"testing"
 	"time"
 
@@ -21,13 +14,6 @@ import (
 	"github.com/weaveworks/flux/image"
 )
 
-func strOrDie(s string, err error) string {
-	if err != nil {
-		log.Fatal(err)
-	}
-	return s
-}
-
 func ignoreErr(s string, err error) string {
 	if err != nil {
 		return ""
@@ -35,42 +21,22 @@ func ignoreErr(s string, err error) string {
 	return s
 }
 
-func envExec(ctx context.Context, t *testing.T, env []string, command string, args ...string) (string, error) {
-	return envExecStdin(ctx, t, env, strings.NewReader(""), command, args...)
-}
-
-func envExecStdin(ctx context.Context, t *testing.T, env []string, stdin io.Reader, command string, args ...string) (string, error) {
-	cmd := exec.CommandContext(ctx, command, args...)
-	cmd.Env = env
-	cmd.Stdin = stdin
-	if t != nil {
-		t.Logf("running %v", cmd.Args)
-	} else {
-		log.Printf("running %v", cmd.Args)
-	}
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("error running %v: %v\nOutput:\n%s", cmd.Args, err, out)
-	}
-	return string(out), err
-}
-
-func envExecNoErr(ctx context.Context, t *testing.T, env []string, command string, args ...string) string {
-	out, err := envExec(ctx, t, env, command, args...)
-	return strOrDie(string(out), err)
-}
-
-func execNoErr(ctx context.Context, t *testing.T, command string, args ...string) string {
-	return envExecNoErr(ctx, t, nil, command, args...)
-}
-
+// until calls f once a second until it succeeds or ctx expires.  Each
+// attempt is recorded in the audit log carried by ctx, if any.
 func until(ctx context.Context, f func(context.Context) error) error {
 	var err error
+	al := auditLogFrom(ctx)
 	ticker := time.NewTicker(time.Second)
-	for {
+	for attempt := 1; ; attempt++ {
 		select {
 		case <-ticker.C:
+			start := time.Now()
 			err = f(ctx)
+			ev := auditEvent{Time: start, Kind: "poll", Duration: time.Since(start), Attempt: attempt}
+			if err != nil {
+				ev.Error = err.Error()
+			}
+			al.record(ev)
 			if err == nil {
 				return nil
 			}
@@ -80,19 +46,19 @@ func until(ctx context.Context, f func(context.Context) error) error {
 	}
 }
 
-func fluxServicesAPICall(ctx context.Context, fluxURL string, namespace string) ([]v6.ControllerStatus, error) {
-	api := client.New(http.DefaultClient, transport.NewAPIRouter(), fluxURL, "")
+func fluxServicesAPICall(ctx context.Context, p probeAPI, fluxURL string, namespace string) ([]v6.ControllerStatus, error) {
+	api := client.New(auditLogFrom(ctx).httpClient(), transport.NewAPIRouter(), fluxURL, "")
 	var controllers []v6.ControllerStatus
 	return controllers, until(ctx, func(ictx context.Context) error {
-		var err error
-		controllers, err = api.ListServices(ictx, namespace)
-		return err
+		return p.call(ictx, &controllers, func(ctx context.Context) (interface{}, error) {
+			return api.ListServices(ctx, namespace)
+		}, "flux-api", "list-services", fluxURL, namespace)
 	})
 }
 
 // fluxServices asks flux for the services it's managing, return a map from container name to id.
-func fluxServices(ctx context.Context, fluxURL string, t *testing.T, namespace string, id string) map[string]image.Ref {
-	controllers, err := fluxServicesAPICall(ctx, fluxURL, namespace)
+func fluxServices(ctx context.Context, p probeAPI, fluxURL string, t *testing.T, namespace string, id string) map[string]image.Ref {
+	controllers, err := fluxServicesAPICall(ctx, p, fluxURL, namespace)
 	if err != nil {
 		t.Errorf("failed to fetch controllers from flux agent: %v", err)
 	}
@@ -109,27 +75,12 @@ func fluxServices(ctx context.Context, fluxURL string, t *testing.T, namespace s
 	return result
 }
 
-func httpGet(ctx context.Context, url string) (string, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return "", err
-	}
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	return string(body), err
-}
-
-func httpGetReturns(host string, port int, expected string) error {
+func httpGetReturns(ctx context.Context, p probeAPI, host string, port int, expected string) error {
 	url := fmt.Sprintf("http://%s:%d", host, port)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 	return until(ctx, func(ictx context.Context) error {
-		got, err := httpGet(ictx, url)
+		got, err := p.get(ictx, url)
 		if err != nil || got != expected {
 			return fmt.Errorf("service check on %d failed, got %q, error: %v", port, got, err)
 		}
@@ -137,17 +88,19 @@ func httpGetReturns(host string, port int, expected string) error {
 	})
 }
 
-func portOpen(ctx context.Context, host string, port int) error {
+func portOpen(ctx context.Context, p probeAPI, host string, port int) error {
+	return portOpenWithin(ctx, p, host, port, 30*time.Second)
+}
+
+func portOpenWithin(ctx context.Context, p probeAPI, host string, port int, timeout time.Duration) error {
 	dest := fmt.Sprintf("%s:%d", host, port)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	return until(ctx, func(ictx context.Context) error {
-		conn, err := net.Dial("tcp", dest)
-		if err != nil {
+		if err := p.dial(ictx, dest); err != nil {
 			return fmt.Errorf("unable to open port %s: %v", dest, err)
 		}
-		conn.Close()
 		return nil
 	})
 }
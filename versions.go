@@ -0,0 +1,244 @@
+package test
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// semver is a parsed version.  Any pre-release or build suffix is kept
+	// for display but ignored when comparing, since distributions tack
+	// their own onto upstream versions, e.g. v1.11.5-gke.5.
+	semver struct {
+		major, minor, patch int
+		suffix              string
+	}
+
+	// versionConstraint is a comparison such as >=1.10.
+	versionConstraint struct {
+		op string
+		v  semver
+	}
+
+	// versionRange holds if all its constraints do.  It's written as the
+	// constraints separated by spaces, e.g. ">=1.10 <1.13".
+	versionRange []versionConstraint
+
+	// excludedVersions is a range of versions known not to work, and why.
+	// The reason should link to the issue.
+	excludedVersions struct {
+		versions string
+		reason   string
+	}
+
+	// compatibility declares which versions of a component the tests
+	// support.
+	compatibility struct {
+		component string
+		supported string
+		excluded  []excludedVersions
+		// preferred is the version to use when we get to choose, e.g. when
+		// starting a cluster.
+		preferred string
+	}
+
+	// versionSet holds the parsed version of each component in use, keyed
+	// by component name.
+	versionSet struct {
+		mu       sync.Mutex
+		versions map[string]semver
+	}
+)
+
+var (
+	semverRE     = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?([-+].*)?$`)
+	constraintRE = regexp.MustCompile(`^(>=|<=|!=|=|>|<)?(.+)$`)
+
+	kubernetesCompat = compatibility{
+		component: "kubernetes",
+		supported: ">=1.10 <1.13",
+		excluded: []excludedVersions{
+			{"<1.9.5", "subPath volume mounts are broken, " +
+				"see https://github.com/kubernetes/kubernetes/issues/61076"},
+			{">=1.9.5 <1.10", "minikube can't start a cluster running it, " +
+				"see https://github.com/kubernetes/minikube/issues/3028"},
+		},
+		preferred: "v1.10.6",
+	}
+	minikubeCompat = compatibility{
+		component: "minikube",
+		supported: ">=0.28.1 <1",
+		preferred: "v0.28.1",
+	}
+	helmCompat = compatibility{
+		component: "helm",
+		supported: ">=2.9.1 <3",
+		preferred: "v2.9.1",
+	}
+
+	// componentVersions records every version checked against a
+	// compatibility, so that tests can adapt to what they're running with.
+	componentVersions = newVersionSet()
+)
+
+func parseSemver(s string) (semver, error) {
+	m := semverRE.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return semver{}, fmt.Errorf("%q is not a version", s)
+	}
+	var v semver
+	v.major, _ = strconv.Atoi(m[1])
+	v.minor, _ = strconv.Atoi(m[2])
+	v.patch, _ = strconv.Atoi(m[3])
+	v.suffix = m[4]
+	return v, nil
+}
+
+func (v semver) String() string {
+	return fmt.Sprintf("v%d.%d.%d%s", v.major, v.minor, v.patch, v.suffix)
+}
+
+// compare returns -1, 0 or 1 as v is less than, equal to or greater than o.
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+func parseVersionRange(s string) (versionRange, error) {
+	var r versionRange
+	for _, field := range strings.Fields(s) {
+		m := constraintRE.FindStringSubmatch(field)
+		v, err := parseSemver(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("bad version range %q: %v", s, err)
+		}
+		op := m[1]
+		if op == "" {
+			op = "="
+		}
+		r = append(r, versionConstraint{op: op, v: v})
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("empty version range")
+	}
+	return r, nil
+}
+
+func (r versionRange) contains(v semver) bool {
+	for _, c := range r {
+		cmp := v.compare(c.v)
+		var ok bool
+		switch c.op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// versionInRange reports whether version is in the range given by
+// constraints.
+func versionInRange(version string, constraints string) (bool, error) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return false, err
+	}
+	r, err := parseVersionRange(constraints)
+	if err != nil {
+		return false, err
+	}
+	return r.contains(v), nil
+}
+
+// check parses version and returns an error if it isn't supported, giving
+// the reason if it's one we know to be broken.
+func (c compatibility) check(version string) (semver, error) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return v, fmt.Errorf("unable to parse %s version: %v", c.component, err)
+	}
+	for _, ex := range c.excluded {
+		ok, err := versionInRange(version, ex.versions)
+		if err != nil {
+			return v, err
+		}
+		if ok {
+			return v, fmt.Errorf("%s version %s is known not to work (%s): %s",
+				c.component, v, ex.versions, ex.reason)
+		}
+	}
+	ok, err := versionInRange(version, c.supported)
+	if err != nil {
+		return v, err
+	}
+	if !ok {
+		return v, fmt.Errorf("%s version %s is not supported, want %s", c.component, v, c.supported)
+	}
+	return v, nil
+}
+
+// mustCheck is like check but fatal on error, and records the version in
+// componentVersions.
+func (c compatibility) mustCheck(lg logger, version string) semver {
+	v, err := c.check(version)
+	if err != nil {
+		lg.Fatalf("%v", err)
+	}
+	componentVersions.set(c.component, v)
+	return v
+}
+
+func newVersionSet() *versionSet {
+	return &versionSet{versions: make(map[string]semver)}
+}
+
+func (vs *versionSet) set(component string, v semver) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.versions[component] = v
+}
+
+// get returns the version recorded for component, if any.
+func (vs *versionSet) get(component string) (semver, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	v, ok := vs.versions[component]
+	return v, ok
+}
+
+// satisfies reports whether the recorded version of component is in the
+// range given by constraints.  It's an error if none was recorded.
+func (vs *versionSet) satisfies(component string, constraints string) (bool, error) {
+	v, ok := vs.get(component)
+	if !ok {
+		return false, fmt.Errorf("no %s version recorded", component)
+	}
+	r, err := parseVersionRange(constraints)
+	if err != nil {
+		return false, err
+	}
+	return r.contains(v), nil
+}
@@ -0,0 +1,146 @@
+package test
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"v1.10.6", "v1.10.6"},
+		{"1.10", "v1.10.0"},
+		{"v1.11.5-gke.5", "v1.11.5-gke.5"},
+		{"0.28.1\n", "v0.28.1"},
+	} {
+		v, err := parseSemver(tc.in)
+		if err != nil || v.String() != tc.want {
+			t.Errorf("parseSemver(%q) = %v, %v; want %s", tc.in, v, err, tc.want)
+		}
+	}
+	if _, err := parseSemver("latest"); err == nil {
+		t.Errorf("parseSemver(latest) succeeded")
+	}
+}
+
+func TestVersionInRange(t *testing.T) {
+	for _, tc := range []struct {
+		version, constraints string
+		want                 bool
+	}{
+		{"v1.10.6", ">=1.10 <1.13", true},
+		{"v1.12.9", ">=1.10 <1.13", true},
+		{"v1.13.0", ">=1.10 <1.13", false},
+		{"v1.9.11", ">=1.10 <1.13", false},
+		{"v1.11.5-gke.5", ">=1.10 <1.13", true},
+		{"v2.9.1", "2.9.1", true},
+		{"v2.9.1", "!=2.9.1", false},
+		{"v2.9.1", ">2.9.1", false},
+		{"v2.9.1", "<=2.9.1", true},
+	} {
+		got, err := versionInRange(tc.version, tc.constraints)
+		if err != nil || got != tc.want {
+			t.Errorf("versionInRange(%q, %q) = %v, %v; want %v", tc.version, tc.constraints, got, err, tc.want)
+		}
+	}
+	if _, err := versionInRange("v1.10.6", ">=one"); err == nil {
+		t.Errorf("versionInRange accepted a bad range")
+	}
+}
+
+func TestCompatibilityCheck(t *testing.T) {
+	for _, c := range []compatibility{kubernetesCompat, minikubeCompat, helmCompat} {
+		if _, err := c.check(c.preferred); err != nil {
+			t.Errorf("preferred %s version isn't supported: %v", c.component, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		version string
+		want    string
+	}{
+		{"v1.11.3", ""},
+		{"v1.9.4", "kubernetes/issues/61076"},
+		{"v1.9.8", "minikube/issues/3028"},
+		{"v1.8.0", "kubernetes/issues/61076"},
+		{"v1.13.0", "not supported, want >=1.10 <1.13"},
+		{"nightly", "unable to parse"},
+	} {
+		_, err := kubernetesCompat.check(tc.version)
+		if (err == nil) != (tc.want == "") || (err != nil && !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("check(%q) = %v, want error containing %q", tc.version, err, tc.want)
+		}
+	}
+
+	c := compatibility{
+		component: "widget",
+		supported: ">=1.0 <2",
+		excluded:  []excludedVersions{{"1.2.3", "https://example.com/widget/issues/1"}},
+	}
+	if _, err := c.check("v1.2.3"); err == nil || !strings.Contains(err.Error(), "widget/issues/1") {
+		t.Errorf("check(v1.2.3) = %v, want error giving the reason it's excluded", err)
+	}
+	if _, err := c.check("v1.2.4"); err != nil {
+		t.Errorf("check(v1.2.4) = %v, want no error", err)
+	}
+}
+
+func TestVersionSet(t *testing.T) {
+	vs := newVersionSet()
+	if _, err := vs.satisfies("kubernetes", ">=1.10"); err == nil {
+		t.Errorf("satisfies succeeded with nothing recorded")
+	}
+	v, _ := parseSemver("v1.11.3")
+	vs.set("kubernetes", v)
+	if ok, err := vs.satisfies("kubernetes", ">=1.10 <1.12"); err != nil || !ok {
+		t.Errorf("satisfies(>=1.10 <1.12) = %v, %v; want true", ok, err)
+	}
+	if ok, _ := vs.satisfies("kubernetes", ">=1.12"); ok {
+		t.Errorf("satisfies(>=1.12) = true for v1.11.3")
+	}
+}
+
+// skipUnlessVersion skips the test unless the version of component in use,
+// as recorded by the compatibility checks in TestMain, is in the range given
+// by constraints, e.g. skipUnlessVersion(t, "kubernetes", ">=1.11").
+func skipUnlessVersion(t *testing.T, component string, constraints string) {
+	t.Helper()
+	ok, err := componentVersions.satisfies(component, constraints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		v, _ := componentVersions.get(component)
+		t.Skipf("needs %s %s, running %s", component, constraints, v)
+	}
+}
+
+func TestSkipUnlessVersion(t *testing.T) {
+	saved := componentVersions
+	defer func() { componentVersions = saved }()
+	componentVersions = newVersionSet()
+	v, _ := parseSemver("v1.11.3")
+	componentVersions.set("kubernetes", v)
+
+	for _, tc := range []struct {
+		constraints string
+		wantSkip    bool
+	}{
+		{">=1.11", false},
+		{">=1.10 <1.12", false},
+		{">=1.12", true},
+		{"<1.11", true},
+	} {
+		ran := false
+		t.Run(tc.constraints, func(t *testing.T) {
+			skipUnlessVersion(t, "kubernetes", tc.constraints)
+			ran = true
+		})
+		if ran == tc.wantSkip {
+			t.Errorf("skipUnlessVersion(%q) with kubernetes %s: ran %v, want skipped %v",
+				tc.constraints, v, ran, tc.wantSkip)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	fakeProfile = "fakeprofile"
+)
+
+func helmVersionOutput(clientOrServer, version string) string {
+	return clientOrServer + `: &version.Version{SemVer:"` + version +
+		`", GitCommit:"20adb27c7c5868466912eebdf6664e7390ebe710", GitTreeState:"clean"}` + "\n"
+}
+
+func kubectlVersionOutput(version string) string {
+	return `Client Version: version.Info{Major:"1", Minor:"10", GitVersion:"v1.10.3", GitTreeState:"clean"}
+Server Version: version.Info{Major:"1", Minor:"10", GitVersion:"` + version + `", GitTreeState:"clean"}
+`
+}
+
+func TestMustNewHelm(t *testing.T) {
+	ht := helmTool{bin: "helm", profile: fakeProfile, helmhome: "/helmhome"}
+	kt := kubectlTool{bin: "kubectl", profile: fakeProfile}
+
+	for _, tc := range []struct {
+		name          string
+		tillerVersion string
+	}{
+		{"tiller current", helmCompat.preferred},
+		{"tiller missing", ""},
+		{"tiller mismatch", "v2.8.0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeCli(t)
+			f.expect(ht.versionCmd("client")...).returns(helmVersionOutput("Client", helmCompat.preferred))
+			if tc.tillerVersion == helmCompat.preferred {
+				f.expect(ht.versionCmd("server")...).returns(helmVersionOutput("Server", helmCompat.preferred))
+			} else {
+				if tc.tillerVersion == "" {
+					f.expect(ht.versionCmd("server")...).fails("Error: could not find tiller")
+				} else {
+					f.expect(ht.versionCmd("server")...).returns(helmVersionOutput("Server", tc.tillerVersion))
+				}
+				f.expect(append(kt.createCmd("kube-system"), "sa", "tiller")...)
+				f.expect(append(kt.createCmd("kube-system"), "clusterrolebinding", "tiller-cluster-rule",
+					"--clusterrole=cluster-admin", "--serviceaccount=kube-system:tiller")...)
+				f.expect(ht.initCmd()...)
+			}
+			// mustNewHelm always rechecks the tiller version.
+			f.expect(ht.versionCmd("server")...).returns(helmVersionOutput("Server", helmCompat.preferred))
+			defer f.install()()
+
+			mustNewHelm(t, "helm", fakeProfile, "", "/helmhome", kubectl{kt: kt, lg: t})
+		})
+	}
+}
+
+func TestMustNewHelmClientMismatch(t *testing.T) {
+	ht := helmTool{bin: "helm", profile: fakeProfile, helmhome: "/helmhome"}
+	f := newFakeCli(t)
+	f.expect(ht.versionCmd("client")...).returns(helmVersionOutput("Client", "v2.8.0"))
+	defer f.install()()
+
+	msg := expectFatal(t, func(lg logger) {
+		mustNewHelm(lg, "helm", fakeProfile, "", "/helmhome", kubectl{kt: kubectlTool{bin: "kubectl", profile: fakeProfile}, lg: lg})
+	})
+	if !strings.Contains(msg, "helm version v2.8.0 is not supported") {
+		t.Errorf("unexpected fatal message %q", msg)
+	}
+}
+
+func TestMustNewKubectl(t *testing.T) {
+	kt := kubectlTool{bin: "kubectl", profile: fakeProfile}
+
+	f := newFakeCli(t)
+	f.expect(kt.versionCmd()...).returns(kubectlVersionOutput(kubernetesCompat.preferred))
+	restore := f.install()
+	mustNewKubectl(t, "kubectl", fakeProfile, "")
+	restore()
+
+	f = newFakeCli(t)
+	f.expect(kt.versionCmd()...).returns(kubectlVersionOutput("v1.9.4"))
+	defer f.install()()
+	msg := expectFatal(t, func(lg logger) { mustNewKubectl(lg, "kubectl", fakeProfile, "") })
+	if !strings.Contains(msg, "v1.9.4") || !strings.Contains(msg, "kubernetes/issues/61076") {
+		t.Errorf("unexpected fatal message %q", msg)
+	}
+}
+
+func TestMustNewMinikube(t *testing.T) {
+	mt := minikubeTool{bin: "minikube", profile: fakeProfile}
+
+	f := newFakeCli(t)
+	f.expect(mt.versionCmd()...).returns("minikube version: " + minikubeCompat.preferred + "\n")
+	restore := f.install()
+	mustNewMinikube(t, "minikube", fakeProfile, "")
+	restore()
+
+	f = newFakeCli(t)
+	f.expect(mt.versionCmd()...).returns("minikube version: v0.25.0\n")
+	defer f.install()()
+	expectFatal(t, func(lg logger) { mustNewMinikube(lg, "minikube", fakeProfile, "") })
+}
+
+func TestKubeconfigCluster(t *testing.T) {
+	kt := kubectlTool{bin: "kubectl", profile: fakeProfile}
+
+	f := newFakeCli(t)
+	f.expect(kt.currentContextCmd()...).returns(fakeProfile + "\n")
+	f.expect(kt.nodeIPCmd()...).returns("192.168.99.100")
+	restore := f.install()
+	c := mustNewKubeconfigCluster(t, "kubectl", "")
+	if got := c.kubeContext(); got != fakeProfile {
+		t.Errorf("kubeContext() = %q, want %q", got, fakeProfile)
+	}
+	if got := c.nodeIP(); got != "192.168.99.100" {
+		t.Errorf("nodeIP() = %q, want 192.168.99.100", got)
+	}
+	restore()
+
+	// An explicit context is used as given.
+	f = newFakeCli(t)
+	restore = f.install()
+	if got := mustNewKubeconfigCluster(t, "kubectl", "other").kubeContext(); got != "other" {
+		t.Errorf("kubeContext() = %q, want other", got)
+	}
+	restore()
+
+	f = newFakeCli(t)
+	f.expect(kt.currentContextCmd()...).fails("error: current-context is not set")
+	defer f.install()()
+	expectFatal(t, func(lg logger) { mustNewKubeconfigCluster(lg, "kubectl", "") })
+}
+
+// TestKubeconfigClusterEnv checks that our KUBECONFIG reaches kubectl and
+// helm, even though childEnv stops them inheriting it.
+func TestKubeconfigClusterEnv(t *testing.T) {
+	const kubeconfig = "/home/me/.kube/a:/home/me/.kube/b"
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	os.Setenv("KUBECONFIG", kubeconfig)
+
+	var envs [][]string
+	f := newFakeCli(t)
+	saved := cliDecorators
+	cliDecorators = []func(logger, []string, executor) executor{
+		func(lg logger, env []string, e executor) executor {
+			envs = append(envs, env)
+			return f
+		},
+	}
+	defer func() { cliDecorators = saved }()
+
+	c := mustNewKubeconfigCluster(t, "kubectl", "other")
+	if got := c.kubeconfig(); got != kubeconfig {
+		t.Errorf("kubeconfig() = %q, want %q", got, kubeconfig)
+	}
+	kt := kubectlTool{bin: "kubectl", profile: "other", kubeconfig: kubeconfig}
+	ht := helmTool{bin: "helm", profile: "other", kubeconfig: kubeconfig, helmhome: "/helmhome"}
+	f.expect(kt.nodeIPCmd()...).returns("192.168.99.100")
+	f.expect(append(kt.getCmd("flux"), "pods")...)
+	f.expect(ht.listCmd()...)
+	c.nodeIP()
+	kubectl{kt: kt, lg: t}.get("flux", "pods")
+	helm{ht: ht, lg: t}.list()
+	f.verify()
+
+	want := []string{"KUBECONFIG=" + kubeconfig}
+	if len(envs) != 3 {
+		t.Fatalf("got %d clicmds, want 3", len(envs))
+	}
+	for i, env := range envs {
+		if !reflect.DeepEqual(env, want) {
+			t.Errorf("clicmd %d has env %v, want %v", i, env, want)
+		}
+	}
+}
+
+func TestLookupClusterProvider(t *testing.T) {
+	if _, err := lookupClusterProvider("kubeconfig"); err != nil {
+		t.Errorf("lookupClusterProvider(kubeconfig) = %v", err)
+	}
+	if _, err := lookupClusterProvider("kind"); err == nil || !strings.Contains(err.Error(), "minikube") {
+		t.Errorf("lookupClusterProvider(kind) = %v, want an error listing the providers", err)
+	}
+}
+
+func TestMustNewGit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repodir := filepath.Join(dir, "repo")
+	origin := "ssh://git@127.0.0.1:30022/repo.git"
+
+	f := newFakeCli(t)
+	f.expectMatch("git clone", func(args []string) bool {
+		return len(args) > 2 && args[0] == "git" && args[1] == "clone" && args[2] == origin
+	})
+	restore := f.install()
+	mustNewGit(t, "git", repodir, nil, origin, "master")
+	restore()
+
+	if err := os.Mkdir(repodir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f = newFakeCli(t)
+	defer f.install()()
+	expectFatal(t, func(lg logger) { mustNewGit(lg, "git", repodir, nil, origin, "master") })
+}